@@ -0,0 +1,294 @@
+package phd2
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BacklashConfig configures a BacklashMeasurement.
+type BacklashConfig struct {
+	// Pulse is the length of each guide pulse. Defaults to 500ms.
+	Pulse time.Duration
+	// MaxPulses is how many pulses to send in each direction before giving
+	// up. Defaults to 30.
+	MaxPulses int
+	// ConsistentPulses is how many pulses in a row must each move the star
+	// by at least MinMoveFraction of the distance expected from the
+	// calibration for backlash to be cleared. They default to 3 and 0.5.
+	ConsistentPulses int
+	MinMoveFraction  float64
+	// FramesPerPulse is how many frames to wait for after each pulse before
+	// measuring the star. Defaults to 2, so that the star is measured in a
+	// frame exposed after the pulse ended.
+	FramesPerPulse int
+	// LoopFrames is how many frames to wait for after looping starts before
+	// selecting a star. Defaults to 3.
+	LoopFrames int
+	// Settle is used when restoring guiding.
+	Settle Settle
+	// RestoreTimeout limits restoring guiding, which is done even if the
+	// measurement's context is done. Defaults to 2 minutes.
+	RestoreTimeout time.Duration
+}
+
+// BacklashResult is the result of a BacklashMeasurement.
+type BacklashResult struct {
+	// NorthRate is the Dec rate measured once backlash was cleared, in
+	// pixels/second.
+	NorthRate float64
+	// Backlash is how long south pulses ran before the star moved back, and
+	// BacklashPixels how far the star would have moved in that time.
+	Backlash       time.Duration
+	BacklashPixels float64
+	// Confidence, between 0 and 1, is how consistently the star moved with
+	// each pulse once backlash was cleared. Seeing and a low rate lower it.
+	Confidence  float64
+	NorthPulses int
+	SouthPulses int
+}
+
+// BacklashMeasurement measures Dec backlash by pulsing the mount north until
+// the star moves consistently, then south until it moves back. The star is
+// measured with FindStar while looping, as PHD2 does not allow guide pulses
+// while guiding. If PHD2 was guiding, guiding is restored at the old lock
+// position afterwards.
+//
+// BacklashMeasurement must receive the client's events through HandleEvent
+// (see DispatchEvents).
+type BacklashMeasurement struct {
+	c      *RPCClient
+	config BacklashConfig
+	queue  *eventQueue
+
+	// decX and decY are the unit vector of the Dec axis in the camera frame.
+	decX, decY float64
+}
+
+// NewBacklashMeasurement creates a new BacklashMeasurement.
+func NewBacklashMeasurement(c *RPCClient, config BacklashConfig) *BacklashMeasurement {
+	if config.Pulse <= 0 {
+		config.Pulse = 500 * time.Millisecond
+	}
+
+	if config.MaxPulses <= 0 {
+		config.MaxPulses = 30
+	}
+
+	if config.ConsistentPulses <= 0 {
+		config.ConsistentPulses = 3
+	}
+
+	if config.MinMoveFraction <= 0 {
+		config.MinMoveFraction = 0.5
+	}
+
+	if config.FramesPerPulse <= 0 {
+		config.FramesPerPulse = 2
+	}
+
+	if config.LoopFrames <= 0 {
+		config.LoopFrames = 3
+	}
+
+	if config.RestoreTimeout <= 0 {
+		config.RestoreTimeout = 2 * time.Minute
+	}
+
+	return &BacklashMeasurement{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent queues events for measuring.
+func (b *BacklashMeasurement) HandleEvent(evt interface{}) {
+	b.queue.HandleEvent(evt)
+}
+
+// Measure measures the Dec backlash.
+func (b *BacklashMeasurement) Measure(ctx context.Context) (result BacklashResult, err error) {
+	cal, err := b.c.GetCalibrationData(MountTypeMount)
+	if err != nil {
+		return result, errors.Wrap(err, "error getting calibration data")
+	}
+
+	if !cal.Calibrated {
+		return result, errors.New("the mount is not calibrated")
+	}
+
+	b.decY, b.decX = math.Sincos(cal.YAngle * math.Pi / 180)
+
+	state, err := b.c.GetAppState()
+	if err != nil {
+		return result, errors.Wrap(err, "error getting app state")
+	}
+
+	lock, err := b.c.GetLockPositionF()
+	if err != nil {
+		return result, errors.Wrap(err, "error getting lock position")
+	}
+
+	if state == AppStateGuiding {
+		defer func() {
+			restoreErr := b.restore(lock)
+			if restoreErr != nil && err == nil {
+				err = errors.Wrap(restoreErr, "error restoring guiding")
+			}
+		}()
+	}
+
+	err = b.startLooping(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	expected := cal.YRate * b.config.Pulse.Seconds()
+	minMove := b.config.MinMoveFraction * expected
+
+	pos, err := b.position()
+	if err != nil {
+		return result, err
+	}
+
+	var moves []float64
+
+	for len(moves) < b.config.ConsistentPulses {
+		if result.NorthPulses == b.config.MaxPulses {
+			return result, errors.Errorf("star did not move consistently after %d north pulses", result.NorthPulses)
+		}
+
+		result.NorthPulses++
+
+		next, err := b.pulse(ctx, "N")
+		if err != nil {
+			return result, err
+		}
+
+		if next-pos >= minMove {
+			moves = append(moves, next-pos)
+		} else {
+			moves = nil
+		}
+
+		pos = next
+	}
+
+	move := mean(moves)
+	rate := move / b.config.Pulse.Seconds()
+	start := pos
+
+	result.NorthRate = rate
+	result.Confidence = math.Max(0, 1-stdDev(moves)/move)
+
+	for {
+		if result.SouthPulses == b.config.MaxPulses {
+			return result, errors.Errorf("star did not move back after %d south pulses", result.SouthPulses)
+		}
+
+		result.SouthPulses++
+
+		pos, err = b.pulse(ctx, "S")
+		if err != nil {
+			return result, err
+		}
+
+		returned := start - pos
+		if returned >= move {
+			// The star moved back at the measured rate for part of the
+			// pulses; the rest of the time went on backlash.
+			south := b.config.Pulse.Seconds() * float64(result.SouthPulses)
+			backlash := math.Max(0, south-returned/rate)
+
+			result.Backlash = time.Duration(backlash * float64(time.Second))
+			result.BacklashPixels = backlash * rate
+
+			return result, nil
+		}
+	}
+}
+
+func (b *BacklashMeasurement) startLooping(ctx context.Context) error {
+	err := b.c.StopCapture()
+	if err != nil {
+		return errors.Wrap(err, "error stopping capture")
+	}
+
+	err = waitForAppState(ctx, b.c, AppStateStopped)
+	if err != nil {
+		return errors.Wrap(err, "error waiting for capture to stop")
+	}
+
+	b.queue.clear()
+
+	err = b.c.Loop()
+	if err != nil {
+		return errors.Wrap(err, "error starting looping")
+	}
+
+	return errors.Wrap(b.queue.waitForFrames(ctx, b.config.LoopFrames), "error waiting for frames")
+}
+
+// pulse sends a pulse and returns the star's position along the Dec axis once
+// it has been measured in a new frame.
+func (b *BacklashMeasurement) pulse(ctx context.Context, direction string) (float64, error) {
+	err := b.c.GuidePulseMount(b.config.Pulse, direction)
+	if err != nil {
+		return 0, errors.Wrap(err, "error sending guide pulse")
+	}
+
+	select {
+	case <-time.After(b.config.Pulse):
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	// Frames taken during the pulse may have been exposed before it.
+	b.queue.clear()
+
+	err = b.queue.waitForFrames(ctx, b.config.FramesPerPulse)
+	if err != nil {
+		return 0, errors.Wrap(err, "error waiting for frames")
+	}
+
+	return b.position()
+}
+
+// position returns the star's position along the Dec axis.
+func (b *BacklashMeasurement) position() (float64, error) {
+	pos, err := b.c.FindStar()
+	if err != nil {
+		return 0, errors.Wrap(err, "error finding star")
+	}
+
+	if len(pos) != 2 {
+		return 0, errors.Errorf("unexpected star position: %v", pos)
+	}
+
+	return pos[0]*b.decX + pos[1]*b.decY, nil
+}
+
+// restore restarts guiding and moves the lock position back to where it was.
+// It has its own context so the mount is restored when the measurement was
+// cancelled.
+func (b *BacklashMeasurement) restore(lock *LockPosition) error {
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.RestoreTimeout)
+	defer cancel()
+
+	err := restartGuiding(ctx, b.c, b.queue, lock, b.config.LoopFrames, b.config.Settle, false)
+	if err != nil || lock == nil {
+		return err
+	}
+
+	b.queue.clear()
+
+	err = b.c.SetLockPosition(lock.X, lock.Y, true)
+	if err != nil {
+		return errors.Wrap(err, "error restoring lock position")
+	}
+
+	return errors.Wrap(b.queue.waitForGuideSettle(ctx, b.config.Settle), "error waiting for settling")
+}
@@ -0,0 +1,152 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+// fakeDecAxis models a Dec axis with backlash: the gear moves freely within
+// the play before it pushes the mount, which then moves the star by rate
+// pixels/ms.
+type fakeDecAxis struct {
+	mutex sync.Mutex
+	play  float64
+	gear  float64
+	rate  float64
+	y     float64
+}
+
+func (a *fakeDecAxis) pulse(ms float64, north bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if north {
+		a.gear += ms
+		if a.gear > a.play {
+			a.y += (a.gear - a.play) * a.rate
+			a.gear = a.play
+		}
+	} else {
+		a.gear -= ms
+		if a.gear < 0 {
+			a.y += a.gear * a.rate
+			a.gear = 0
+		}
+	}
+}
+
+func (a *fakeDecAxis) position() []float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return []float64{100, a.y}
+}
+
+func TestBacklashMeasurement(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	b := phd2.NewBacklashMeasurement(c, phd2.BacklashConfig{
+		Pulse:  20 * time.Millisecond,
+		Settle: phd2.Settle{Pixels: 1, TimeoutSeconds: 10},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, b)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-time.After(2 * time.Millisecond):
+				fake.emit(&phd2.LoopingExposuresEvent{Event: phd2.Event{Event: "LoopingExposures"}})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	axis := &fakeDecAxis{play: 40, rate: 0.05, y: 100}
+
+	var stateMutex sync.Mutex
+	state := phd2.AppStateGuiding
+	setState := func(s phd2.AppState) (interface{}, error) {
+		stateMutex.Lock()
+		defer stateMutex.Unlock()
+		state = s
+		return 0, nil
+	}
+
+	fake.handle("get_app_state", func([]json.RawMessage) (interface{}, error) {
+		stateMutex.Lock()
+		defer stateMutex.Unlock()
+		return state, nil
+	})
+	fake.handle("stop_capture", func([]json.RawMessage) (interface{}, error) {
+		return setState(phd2.AppStateStopped)
+	})
+	fake.handle("loop", func([]json.RawMessage) (interface{}, error) {
+		return setState(phd2.AppStateLooping)
+	})
+	fake.handle("guide", func([]json.RawMessage) (interface{}, error) {
+		go fake.emit(&phd2.SettleDoneEvent{Event: phd2.Event{Event: "SettleDone"}})
+		return setState(phd2.AppStateGuiding)
+	})
+	fake.handle("set_lock_position", func(params []json.RawMessage) (interface{}, error) {
+		if string(params[2]) == "true" {
+			go fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}})
+		}
+		return 0, nil
+	})
+	fake.result("get_calibration_data", phd2.CalibrationData{Calibrated: true, YAngle: 90, YRate: 50})
+	fake.result("get_lock_position", []float64{100.5, 100.25})
+	fake.handle("find_star", func([]json.RawMessage) (interface{}, error) {
+		return axis.position(), nil
+	})
+	fake.handle("guide_pulse", func(params []json.RawMessage) (interface{}, error) {
+		var ms float64
+		assert.NoError(t, json.Unmarshal(params[0], &ms))
+		axis.pulse(ms, string(params[1]) == `"N"`)
+		return 0, nil
+	})
+
+	result, err := b.Measure(context.Background())
+	require.NoError(t, err)
+
+	// Two north pulses take up the play, then three move the star a pixel
+	// each. Two south pulses take up the play again before the third moves
+	// the star back.
+	assert.Equal(t, 5, result.NorthPulses)
+	assert.Equal(t, 3, result.SouthPulses)
+	assert.InDelta(t, 50, result.NorthRate, 1e-6)
+	assert.Equal(t, 40*time.Millisecond, result.Backlash.Round(time.Millisecond))
+	assert.InDelta(t, 2, result.BacklashPixels, 1e-6)
+	assert.InDelta(t, 1, result.Confidence, 1e-6)
+
+	locks := fake.callsTo("set_lock_position")
+	require.Len(t, locks, 2)
+	assert.Equal(t, "false", string(locks[0].Params[2]))
+	assert.Equal(t, "true", string(locks[1].Params[2]))
+	assert.Equal(t, "100.5", string(locks[1].Params[0]))
+	assert.Equal(t, "100.25", string(locks[1].Params[1]))
+
+	// Guiding is restored even when the measurement is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = b.Measure(ctx)
+	assert.Error(t, err)
+	assert.Len(t, fake.callsTo("guide"), 2)
+	assert.Len(t, fake.callsTo("set_lock_position"), 4)
+}
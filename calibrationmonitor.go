@@ -0,0 +1,244 @@
+package phd2
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CalibrationProblem is a problem found by a CalibrationMonitor.
+type CalibrationProblem string
+
+const (
+	// CalibrationProblemNotMoving means the star has not moved, as with a
+	// stuck mount or a disconnected guide cable.
+	CalibrationProblemNotMoving = CalibrationProblem("NotMoving")
+	// CalibrationProblemTooSlow means the star is moving too slowly to cover
+	// the calibration distance before PHD2 gives up.
+	CalibrationProblemTooSlow = CalibrationProblem("TooSlow")
+)
+
+// CalibrationPoint is the star's position after a calibration step.
+type CalibrationPoint struct {
+	Step int
+	// Distance is how far, in pixels, the star has moved from where the
+	// direction started.
+	Distance float64
+	DX       float64
+	DY       float64
+	X        float64
+	Y        float64
+	// Backlash is true for steps made to clear backlash.
+	Backlash bool
+}
+
+// CalibrationTrack is the star's track while calibrating in one direction.
+type CalibrationTrack struct {
+	Direction string
+	Points    []CalibrationPoint
+}
+
+// CalibrationAlert describes a problem found by a CalibrationMonitor.
+type CalibrationAlert struct {
+	Direction string
+	Problem   CalibrationProblem
+	// Steps is the number of steps made in the direction so far, not
+	// counting backlash clearing, and Distance how far the star moved in them.
+	Steps    int
+	Distance float64
+	Time     time.Time
+	// Aborted is true if calibration was stopped, and Err is set if stopping
+	// it failed.
+	Aborted bool
+	Err     error
+}
+
+// CalibrationMonitorConfig configures a CalibrationMonitor.
+type CalibrationMonitorConfig struct {
+	// StuckSteps is how many steps the star may move less than StuckDistance
+	// pixels before it is considered not to be moving. They default to 5 and
+	// 1.5.
+	StuckSteps    int
+	StuckDistance float64
+	// After SlowSteps steps, the star is considered too slow if at its speed
+	// so far it would take more than MaxSteps steps to cover Distance pixels.
+	// They default to 5, 60 and 25, PHD2's defaults for the maximum number of
+	// steps and the calibration distance.
+	SlowSteps int
+	MaxSteps  int
+	Distance  float64
+	// Abort stops calibration with StopCapture when a problem is found,
+	// rather than letting PHD2 carry on until it times out.
+	Abort bool
+
+	// OnAlert, if set, is called for each problem found. It is called from
+	// the goroutine running Run.
+	OnAlert func(CalibrationAlert)
+}
+
+// CalibrationMonitor builds the star's track in each direction from
+// Calibrating events, and detects a star that is not moving or is moving too
+// slowly early in calibration. Only the west and north directions, which the
+// rates are measured from, are checked, each at most once per calibration.
+// Backlash clearing steps are tracked but not checked, as the star is not
+// expected to move while backlash is being cleared.
+//
+// CalibrationMonitor must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type CalibrationMonitor struct {
+	c      *RPCClient
+	config CalibrationMonitorConfig
+	queue  *eventQueue
+
+	mutex    sync.Mutex
+	tracks   []*CalibrationTrack
+	reported map[string]bool
+}
+
+// NewCalibrationMonitor creates a new CalibrationMonitor.
+func NewCalibrationMonitor(c *RPCClient, config CalibrationMonitorConfig) *CalibrationMonitor {
+	if config.StuckSteps <= 0 {
+		config.StuckSteps = 5
+	}
+
+	if config.StuckDistance <= 0 {
+		config.StuckDistance = 1.5
+	}
+
+	if config.SlowSteps <= 0 {
+		config.SlowSteps = 5
+	}
+
+	if config.MaxSteps <= 0 {
+		config.MaxSteps = 60
+	}
+
+	if config.Distance <= 0 {
+		config.Distance = 25
+	}
+
+	return &CalibrationMonitor{
+		c:        c,
+		config:   config,
+		queue:    newEventQueue(),
+		reported: make(map[string]bool),
+	}
+}
+
+// HandleEvent queues events for Run.
+func (m *CalibrationMonitor) HandleEvent(evt interface{}) {
+	m.queue.HandleEvent(evt)
+}
+
+// Tracks returns the tracks of the current or last calibration, in the order
+// the directions were calibrated.
+func (m *CalibrationMonitor) Tracks() []CalibrationTrack {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tracks := make([]CalibrationTrack, len(m.tracks))
+	for i, track := range m.tracks {
+		tracks[i] = CalibrationTrack{
+			Direction: track.Direction,
+			Points:    append([]CalibrationPoint(nil), track.Points...),
+		}
+	}
+
+	return tracks
+}
+
+// Run monitors calibrations until the context is done.
+func (m *CalibrationMonitor) Run(ctx context.Context) error {
+	return m.queue.waitFor(ctx, func(evt interface{}) (bool, error) {
+		switch e := evt.(type) {
+		case *StartCalibrationEvent:
+			m.mutex.Lock()
+			m.tracks = nil
+			m.reported = make(map[string]bool)
+			m.mutex.Unlock()
+		case *CalibratingEvent:
+			m.step(e)
+		}
+
+		return false, nil
+	})
+}
+
+func (m *CalibrationMonitor) step(e *CalibratingEvent) {
+	point := CalibrationPoint{
+		Step:     e.Step,
+		Distance: e.Dist,
+		DX:       e.DX,
+		DY:       e.DY,
+		Backlash: strings.Contains(strings.ToLower(e.State), "backlash"),
+	}
+
+	if len(e.Pos) == 2 {
+		point.X, point.Y = e.Pos[0], e.Pos[1]
+	}
+
+	m.mutex.Lock()
+
+	var track *CalibrationTrack
+	if len(m.tracks) > 0 && m.tracks[len(m.tracks)-1].Direction == e.Dir {
+		track = m.tracks[len(m.tracks)-1]
+	} else {
+		track = &CalibrationTrack{Direction: e.Dir}
+		m.tracks = append(m.tracks, track)
+	}
+
+	track.Points = append(track.Points, point)
+
+	steps := 0
+	for _, p := range track.Points {
+		if !p.Backlash {
+			steps++
+		}
+	}
+
+	reported := m.reported[e.Dir]
+
+	m.mutex.Unlock()
+
+	// PHD2 measures the rates moving west and north; east and south only
+	// return the star to where it started.
+	measured := e.Dir == "West" || e.Dir == "North"
+
+	if !measured || point.Backlash || reported {
+		return
+	}
+
+	var problem CalibrationProblem
+
+	switch {
+	case steps >= m.config.StuckSteps && math.Abs(e.Dist) < m.config.StuckDistance:
+		problem = CalibrationProblemNotMoving
+	case steps >= m.config.SlowSteps && math.Abs(e.Dist)*float64(m.config.MaxSteps) < m.config.Distance*float64(steps):
+		problem = CalibrationProblemTooSlow
+	default:
+		return
+	}
+
+	m.mutex.Lock()
+	m.reported[e.Dir] = true
+	m.mutex.Unlock()
+
+	alert := CalibrationAlert{
+		Direction: e.Dir,
+		Problem:   problem,
+		Steps:     steps,
+		Distance:  e.Dist,
+		Time:      time.Now(),
+	}
+
+	if m.config.Abort {
+		alert.Aborted = true
+		alert.Err = m.c.StopCapture()
+	}
+
+	if m.config.OnAlert != nil {
+		m.config.OnAlert(alert)
+	}
+}
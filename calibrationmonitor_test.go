@@ -0,0 +1,91 @@
+package phd2_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func calibrationStep(dir, state string, step int, dist float64) *phd2.CalibratingEvent {
+	return &phd2.CalibratingEvent{
+		Event: phd2.Event{Event: "Calibrating"},
+		Dir:   dir,
+		Dist:  dist,
+		DX:    dist,
+		Pos:   []float64{100 + dist, 50},
+		Step:  step,
+		State: state,
+	}
+}
+
+func TestCalibrationMonitor(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	alerts := make(chan phd2.CalibrationAlert, 10)
+	m := phd2.NewCalibrationMonitor(c, phd2.CalibrationMonitorConfig{
+		Abort: true,
+		OnAlert: func(alert phd2.CalibrationAlert) {
+			alerts <- alert
+		},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx) // nolint: errcheck
+
+	fake.emit(&phd2.StartCalibrationEvent{Event: phd2.Event{Event: "StartCalibration"}})
+
+	for i := 1; i <= 6; i++ {
+		fake.emit(calibrationStep("West", "West", i, 3*float64(i)))
+	}
+
+	for i := 1; i <= 6; i++ {
+		fake.emit(calibrationStep("East", "East", i, 18-3*float64(i)))
+	}
+
+	for i := 1; i <= 6; i++ {
+		fake.emit(calibrationStep("North", "Backlash", i, 0))
+	}
+
+	// Moving, but too slowly to cover 25 pixels in 60 steps.
+	for i := 1; i <= 5; i++ {
+		fake.emit(calibrationStep("North", "North", i, 0.3*float64(i)))
+	}
+
+	alert := <-alerts
+	assert.Equal(t, "North", alert.Direction)
+	assert.Equal(t, phd2.CalibrationProblemTooSlow, alert.Problem)
+	assert.Equal(t, 5, alert.Steps)
+	assert.True(t, alert.Aborted)
+	assert.NoError(t, alert.Err)
+	assert.Len(t, fake.callsTo("stop_capture"), 1)
+
+	tracks := m.Tracks()
+	require.Len(t, tracks, 3)
+	assert.Equal(t, "West", tracks[0].Direction)
+	assert.Len(t, tracks[0].Points, 6)
+	assert.Equal(t, 118.0, tracks[0].Points[5].X)
+	assert.Equal(t, "North", tracks[2].Direction)
+	assert.Len(t, tracks[2].Points, 11)
+	assert.True(t, tracks[2].Points[0].Backlash)
+
+	fake.emit(&phd2.StartCalibrationEvent{Event: phd2.Event{Event: "StartCalibration"}})
+
+	for i := 1; i <= 5; i++ {
+		fake.emit(calibrationStep("West", "West", i, 0.1))
+	}
+
+	alert = <-alerts
+	assert.Equal(t, "West", alert.Direction)
+	assert.Equal(t, phd2.CalibrationProblemNotMoving, alert.Problem)
+	assert.Len(t, m.Tracks(), 1)
+}
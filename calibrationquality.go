@@ -0,0 +1,194 @@
+package phd2
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// siderealRate is the sidereal rate in arc-sec/second.
+const siderealRate = 15.0411
+
+// Verdict is the outcome of a check.
+type Verdict string
+
+const (
+	// VerdictPass means nothing is wrong.
+	VerdictPass = Verdict("Pass")
+	// VerdictWarn means something looks wrong but may not matter.
+	VerdictWarn = Verdict("Warn")
+	// VerdictFail means something is wrong enough to redo it.
+	VerdictFail = Verdict("Fail")
+)
+
+// worse returns the worse of two verdicts.
+func (v Verdict) worse(other Verdict) Verdict {
+	rank := map[Verdict]int{VerdictPass: 0, VerdictWarn: 1, VerdictFail: 2}
+	if rank[other] > rank[v] {
+		return other
+	}
+
+	return v
+}
+
+// CalibrationExpectation is what a calibration is expected to look like.
+type CalibrationExpectation struct {
+	// GuideSpeed is the mount's guide speed as a multiple of the sidereal
+	// rate, such as 0.5. If 0, rates are not checked.
+	GuideSpeed float64
+	// PixelScale is the pixel scale in arc-sec/pixel. If 0, rates are not
+	// checked.
+	PixelScale float64
+	// Declination is the declination, in degrees, calibrated at.
+	Declination float64
+	// XParity and YParity, if set, are the expected RA and Dec parities, such
+	// as those of an earlier good calibration on the same side of the pier.
+	XParity string
+	YParity string
+
+	// OrthogonalityWarn and OrthogonalityFail are how many degrees the RA and
+	// Dec axes may be from perpendicular. They default to 5 and 10.
+	OrthogonalityWarn float64
+	OrthogonalityFail float64
+	// RateWarn and RateFail are the fractions by which measured rates may
+	// differ from the expected rates. They default to 0.25 and 0.5.
+	RateWarn float64
+	RateFail float64
+}
+
+// CalibrationCheck is the outcome of one check of a calibration.
+type CalibrationCheck struct {
+	Name    string
+	Verdict Verdict
+	Message string
+}
+
+// CalibrationAssessment is the outcome of checking a calibration.
+type CalibrationAssessment struct {
+	// Verdict is the worst verdict of the checks.
+	Verdict Verdict
+	// OrthogonalityError is how many degrees the RA and Dec axes are from
+	// perpendicular.
+	OrthogonalityError float64
+	// ExpectedXRate and ExpectedYRate are the expected RA and Dec rates in
+	// pixels/second, or 0 if they could not be worked out.
+	ExpectedXRate float64
+	ExpectedYRate float64
+	Checks        []CalibrationCheck
+}
+
+// AssessCalibration checks a calibration in the same way as PHD2's calibration
+// sanity checks: that the axes are perpendicular, that the rates are close to
+// those expected from the guide speed, pixel scale and declination, and that
+// the parities are known and as expected.
+func AssessCalibration(data CalibrationData, expect CalibrationExpectation) CalibrationAssessment {
+	expect = expect.withDefaults()
+
+	a := CalibrationAssessment{
+		Verdict: VerdictPass,
+	}
+
+	if !data.Calibrated {
+		a.add("Calibrated", VerdictFail, "the mount is not calibrated")
+		return a
+	}
+
+	a.OrthogonalityError = math.Abs(90 - angleDifference(data.XAngle, data.YAngle))
+	a.add("Orthogonality",
+		verdictFor(a.OrthogonalityError, expect.OrthogonalityWarn, expect.OrthogonalityFail),
+		fmt.Sprintf("RA and Dec axes are %.1f degrees from perpendicular", a.OrthogonalityError))
+
+	if expect.GuideSpeed > 0 && expect.PixelScale > 0 {
+		a.ExpectedYRate = expect.GuideSpeed * siderealRate / expect.PixelScale
+		a.ExpectedXRate = a.ExpectedYRate * math.Cos(expect.Declination*math.Pi/180)
+
+		a.addRate("RA rate", data.XRate, a.ExpectedXRate, expect)
+		a.addRate("Dec rate", data.YRate, a.ExpectedYRate, expect)
+	}
+
+	a.addParity("RA parity", data.XParity, expect.XParity)
+	a.addParity("Dec parity", data.YParity, expect.YParity)
+
+	return a
+}
+
+// AssessCurrentCalibration checks the mount's calibration. If the expected
+// pixel scale is 0, it is read from PHD2.
+func AssessCurrentCalibration(c *RPCClient, expect CalibrationExpectation) (CalibrationAssessment, error) {
+	data, err := c.GetCalibrationData(MountTypeMount)
+	if err != nil {
+		return CalibrationAssessment{}, errors.Wrap(err, "error getting calibration data")
+	}
+
+	if expect.PixelScale <= 0 {
+		expect.PixelScale, err = c.GetPixelScale()
+		if err != nil {
+			return CalibrationAssessment{}, errors.Wrap(err, "error getting pixel scale")
+		}
+	}
+
+	return AssessCalibration(data, expect), nil
+}
+
+func (e CalibrationExpectation) withDefaults() CalibrationExpectation {
+	if e.OrthogonalityWarn <= 0 {
+		e.OrthogonalityWarn = 5
+	}
+
+	if e.OrthogonalityFail <= 0 {
+		e.OrthogonalityFail = 10
+	}
+
+	if e.RateWarn <= 0 {
+		e.RateWarn = 0.25
+	}
+
+	if e.RateFail <= 0 {
+		e.RateFail = 0.5
+	}
+
+	return e
+}
+
+func (a *CalibrationAssessment) add(name string, verdict Verdict, message string) {
+	a.Checks = append(a.Checks, CalibrationCheck{
+		Name:    name,
+		Verdict: verdict,
+		Message: message,
+	})
+
+	a.Verdict = a.Verdict.worse(verdict)
+}
+
+func (a *CalibrationAssessment) addRate(name string, rate, expected float64, expect CalibrationExpectation) {
+	if expected <= 0 {
+		return
+	}
+
+	diff := math.Abs(rate-expected) / expected
+	a.add(name, verdictFor(diff, expect.RateWarn, expect.RateFail),
+		fmt.Sprintf("%.3f px/s is %.0f%% from the expected %.3f px/s", rate, 100*diff, expected))
+}
+
+func (a *CalibrationAssessment) addParity(name, parity, expected string) {
+	switch {
+	case parity != "+" && parity != "-":
+		a.add(name, VerdictWarn, fmt.Sprintf("parity %q was not determined", parity))
+	case expected != "" && parity != expected:
+		a.add(name, VerdictFail, fmt.Sprintf("parity is %s but %s was expected", parity, expected))
+	default:
+		a.add(name, VerdictPass, fmt.Sprintf("parity is %s", parity))
+	}
+}
+
+func verdictFor(value, warn, fail float64) Verdict {
+	switch {
+	case value > fail:
+		return VerdictFail
+	case value > warn:
+		return VerdictWarn
+	default:
+		return VerdictPass
+	}
+}
@@ -0,0 +1,101 @@
+package phd2_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/goastro/phd2"
+)
+
+func TestAssessCalibration(t *testing.T) {
+	// Expected rates are 2.5 px/s in RA and 5 px/s in Dec.
+	expect := phd2.CalibrationExpectation{
+		GuideSpeed:  0.5,
+		PixelScale:  15.0411 * 0.5 / 5,
+		Declination: 60,
+		YParity:     "+",
+	}
+
+	good := phd2.CalibrationData{
+		Calibrated: true,
+		XAngle:     10,
+		XRate:      2.4,
+		XParity:    "+",
+		YAngle:     -82,
+		YRate:      5.1,
+		YParity:    "+",
+	}
+
+	type testCase struct {
+		name     string
+		modify   func(*phd2.CalibrationData)
+		verdict  phd2.Verdict
+		failures []string
+	}
+
+	testCases := []testCase{
+		{
+			name:    "good",
+			modify:  func(*phd2.CalibrationData) {},
+			verdict: phd2.VerdictPass,
+		},
+		{
+			name:     "not calibrated",
+			modify:   func(d *phd2.CalibrationData) { d.Calibrated = false },
+			verdict:  phd2.VerdictFail,
+			failures: []string{"Calibrated"},
+		},
+		{
+			name:    "slightly skewed",
+			modify:  func(d *phd2.CalibrationData) { d.YAngle = -74 },
+			verdict: phd2.VerdictWarn,
+		},
+		{
+			name:     "skewed across zero",
+			modify:   func(d *phd2.CalibrationData) { d.XAngle, d.YAngle = 350, 65 },
+			verdict:  phd2.VerdictFail,
+			failures: []string{"Orthogonality"},
+		},
+		{
+			name:     "slow Dec",
+			modify:   func(d *phd2.CalibrationData) { d.YRate = 2 },
+			verdict:  phd2.VerdictFail,
+			failures: []string{"Dec rate"},
+		},
+		{
+			name:    "unknown RA parity",
+			modify:  func(d *phd2.CalibrationData) { d.XParity = "?" },
+			verdict: phd2.VerdictWarn,
+		},
+		{
+			name:     "reversed Dec parity",
+			modify:   func(d *phd2.CalibrationData) { d.YParity = "-" },
+			verdict:  phd2.VerdictFail,
+			failures: []string{"Dec parity"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := good
+			tc.modify(&data)
+
+			a := phd2.AssessCalibration(data, expect)
+			assert.Equal(t, tc.verdict, a.Verdict)
+
+			var failures []string
+			for _, check := range a.Checks {
+				if check.Verdict == phd2.VerdictFail {
+					failures = append(failures, check.Name)
+				}
+			}
+			assert.Equal(t, tc.failures, failures)
+		})
+	}
+
+	a := phd2.AssessCalibration(good, expect)
+	assert.InDelta(t, 2, a.OrthogonalityError, 1e-9)
+	assert.InDelta(t, 2.5, a.ExpectedXRate, 1e-9)
+	assert.InDelta(t, 5, a.ExpectedYRate, 1e-9)
+}
@@ -0,0 +1,228 @@
+package phd2
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CoolerSample is a sample of the camera cooler's status.
+type CoolerSample struct {
+	Time time.Time
+	CoolerStatus
+	// SensorTemperature is the temperature reported by GetSensorTemperature.
+	SensorTemperature float64
+}
+
+// CoolerAlertKind is a kind of problem found by a CoolerMonitor.
+type CoolerAlertKind string
+
+const (
+	// CoolerAlertDeviation means the temperature has moved away from the
+	// setpoint after reaching it.
+	CoolerAlertDeviation = CoolerAlertKind("Deviation")
+	// CoolerAlertPowerSaturated means the cooler is running at full power, so
+	// it can no longer hold the setpoint if it gets warmer.
+	CoolerAlertPowerSaturated = CoolerAlertKind("PowerSaturated")
+	// CoolerAlertOff means the cooler was turned off.
+	CoolerAlertOff = CoolerAlertKind("CoolerOff")
+)
+
+// CoolerAlert describes a problem found by a CoolerMonitor, or that it has
+// gone away.
+type CoolerAlert struct {
+	Kind   CoolerAlertKind
+	Sample CoolerSample
+	// Cleared is true when the problem has gone away.
+	Cleared bool
+}
+
+// CoolerMonitorConfig configures a CoolerMonitor.
+type CoolerMonitorConfig struct {
+	// Interval is how often the cooler is sampled. Defaults to 30s.
+	Interval time.Duration
+	// MaxDeviation is how many degrees the temperature may be from the
+	// setpoint. Defaults to 1.
+	MaxDeviation float64
+	// MaxPower is the power percentage that counts as saturated. Defaults to
+	// 100.
+	MaxPower float64
+	// Samples is how many samples in a row a deviation or saturation must be
+	// seen in before it is alerted, so that brief excursions are ignored.
+	// Defaults to 3.
+	Samples int
+	// History is how many samples are kept. Defaults to 2880, a day at the
+	// default interval.
+	History int
+
+	// OnAlert, if set, is called for every alert. It is called from the
+	// goroutine running Run.
+	OnAlert func(CoolerAlert)
+}
+
+// CoolerMonitor samples the camera cooler on an interval, keeps a history of
+// the samples, and alerts when the temperature deviates from the setpoint, the
+// cooler power saturates or the cooler turns off. No deviation is alerted
+// while the camera is still cooling down to the setpoint.
+type CoolerMonitor struct {
+	c      *RPCClient
+	config CoolerMonitorConfig
+
+	mutex   sync.Mutex
+	samples []CoolerSample
+
+	on        bool
+	reached   bool
+	deviating int
+	saturated int
+	active    map[CoolerAlertKind]bool
+}
+
+// NewCoolerMonitor creates a new CoolerMonitor.
+func NewCoolerMonitor(c *RPCClient, config CoolerMonitorConfig) *CoolerMonitor {
+	if config.Interval <= 0 {
+		config.Interval = 30 * time.Second
+	}
+
+	if config.MaxDeviation <= 0 {
+		config.MaxDeviation = 1
+	}
+
+	if config.MaxPower <= 0 {
+		config.MaxPower = 100
+	}
+
+	if config.Samples <= 0 {
+		config.Samples = 3
+	}
+
+	if config.History <= 0 {
+		config.History = 2880
+	}
+
+	return &CoolerMonitor{
+		c:      c,
+		config: config,
+		active: make(map[CoolerAlertKind]bool),
+	}
+}
+
+// Samples returns the samples taken, oldest first.
+func (m *CoolerMonitor) Samples() []CoolerSample {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]CoolerSample(nil), m.samples...)
+}
+
+// Run samples the cooler until the context is done or sampling fails.
+func (m *CoolerMonitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		sample, err := m.sample()
+		if err != nil {
+			return err
+		}
+
+		m.check(sample)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *CoolerMonitor) sample() (CoolerSample, error) {
+	status, err := m.c.GetCoolerStatus()
+	if err != nil {
+		return CoolerSample{}, errors.Wrap(err, "error getting cooler status")
+	}
+
+	temperature, err := m.c.GetSensorTemperature()
+	if err != nil {
+		return CoolerSample{}, errors.Wrap(err, "error getting sensor temperature")
+	}
+
+	sample := CoolerSample{
+		Time:              time.Now(),
+		CoolerStatus:      status,
+		SensorTemperature: temperature,
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.samples = append(m.samples, sample)
+	if len(m.samples) > m.config.History {
+		m.samples = m.samples[len(m.samples)-m.config.History:]
+	}
+
+	return sample, nil
+}
+
+func (m *CoolerMonitor) check(sample CoolerSample) {
+	if !sample.CoolerOn {
+		m.reached = false
+		m.deviating = 0
+		m.saturated = 0
+
+		m.set(CoolerAlertDeviation, false, sample)
+		m.set(CoolerAlertPowerSaturated, false, sample)
+
+		// Only a cooler that was seen on can be turned off.
+		if m.on {
+			m.set(CoolerAlertOff, true, sample)
+		}
+
+		m.on = false
+		return
+	}
+
+	m.on = true
+	m.set(CoolerAlertOff, false, sample)
+
+	if math.Abs(sample.Temperature-sample.Setpoint) <= m.config.MaxDeviation {
+		m.reached = true
+		m.deviating = 0
+		m.set(CoolerAlertDeviation, false, sample)
+	} else if m.reached {
+		m.deviating++
+		if m.deviating >= m.config.Samples {
+			m.set(CoolerAlertDeviation, true, sample)
+		}
+	}
+
+	if sample.Power >= m.config.MaxPower {
+		m.saturated++
+		if m.saturated >= m.config.Samples {
+			m.set(CoolerAlertPowerSaturated, true, sample)
+		}
+	} else {
+		m.saturated = 0
+		m.set(CoolerAlertPowerSaturated, false, sample)
+	}
+}
+
+// set raises or clears an alert if it is not already.
+func (m *CoolerMonitor) set(kind CoolerAlertKind, active bool, sample CoolerSample) {
+	if m.active[kind] == active {
+		return
+	}
+
+	m.active[kind] = active
+
+	if m.config.OnAlert != nil {
+		m.config.OnAlert(CoolerAlert{
+			Kind:    kind,
+			Sample:  sample,
+			Cleared: !active,
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestCoolerMonitor(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	statuses := []phd2.CoolerStatus{
+		// Cooling down at full power.
+		{Temperature: 10, CoolerOn: true, Setpoint: -10, Power: 100},
+		{Temperature: 0, CoolerOn: true, Setpoint: -10, Power: 100},
+		{Temperature: -9.5, CoolerOn: true, Setpoint: -10, Power: 80},
+		// Warming away from the setpoint.
+		{Temperature: -8, CoolerOn: true, Setpoint: -10, Power: 90},
+		{Temperature: -7, CoolerOn: true, Setpoint: -10, Power: 95},
+		{Temperature: -7, CoolerOn: false, Setpoint: -10, Power: 0},
+	}
+
+	var mutex sync.Mutex
+	next := 0
+
+	fake.handle("get_cooler_status", func([]json.RawMessage) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		status := statuses[next]
+		if next < len(statuses)-1 {
+			next++
+		}
+
+		return status, nil
+	})
+	fake.result("get_sensor_temperature", -7)
+
+	alerts := make(chan phd2.CoolerAlert, 10)
+	m := phd2.NewCoolerMonitor(c, phd2.CoolerMonitorConfig{
+		Interval: time.Millisecond,
+		Samples:  2,
+		OnAlert: func(alert phd2.CoolerAlert) {
+			alerts <- alert
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx) // nolint: errcheck
+
+	type testCase struct {
+		Kind        phd2.CoolerAlertKind
+		Cleared     bool
+		Temperature float64
+	}
+
+	testCases := []testCase{
+		{Kind: phd2.CoolerAlertPowerSaturated, Temperature: 0},
+		{Kind: phd2.CoolerAlertPowerSaturated, Cleared: true, Temperature: -9.5},
+		{Kind: phd2.CoolerAlertDeviation, Temperature: -7},
+		{Kind: phd2.CoolerAlertDeviation, Cleared: true, Temperature: -7},
+		{Kind: phd2.CoolerAlertOff, Temperature: -7},
+	}
+
+	for _, tc := range testCases {
+		alert := <-alerts
+		assert.Equal(t, tc.Kind, alert.Kind)
+		assert.Equal(t, tc.Cleared, alert.Cleared)
+		assert.Equal(t, tc.Temperature, alert.Sample.Temperature)
+	}
+
+	select {
+	case alert := <-alerts:
+		t.Errorf("unexpected alert %+v", alert)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	samples := m.Samples()
+	require.True(t, len(samples) > len(statuses))
+	assert.Equal(t, statuses[0], samples[0].CoolerStatus)
+	assert.Equal(t, -7.0, samples[0].SensorTemperature)
+}
@@ -0,0 +1,216 @@
+package phd2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EventHandler is implemented by components that consume the events sent by
+// PHD2. HandleEvent is called from the goroutine that drains the RPCClient
+// events channel, so it must not block or call RPCClient methods; a blocked
+// handler stops method responses from being delivered.
+type EventHandler interface {
+	HandleEvent(evt interface{})
+}
+
+// EventHandlerFunc allows an ordinary function to be used as an EventHandler.
+type EventHandlerFunc func(evt interface{})
+
+// HandleEvent calls f(evt).
+func (f EventHandlerFunc) HandleEvent(evt interface{}) {
+	f(evt)
+}
+
+// DispatchEvents delivers every event received on the events channel to each
+// of the handlers, in order, until the channel is closed. RPCClient only allows
+// a single subscriber, so this is how several components share its events:
+//
+//	events, err := c.Subscribe()
+//	...
+//	go phd2.DispatchEvents(events, stats, recovery)
+func DispatchEvents(events <-chan interface{}, handlers ...EventHandler) {
+	for evt := range events {
+		for _, h := range handlers {
+			h.HandleEvent(evt)
+		}
+	}
+}
+
+// ReplayEvents delivers the events of a recorded session to each of the
+// handlers, in order. The recording holds one event per line as PHD2 sends them
+// on its event socket; other lines, such as method responses, and unknown
+// events are skipped.
+func ReplayEvents(r io.Reader, handlers ...EventHandler) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		var e Event
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+
+		evt, ok := getEvent(e.Event)
+		if !ok {
+			continue
+		}
+
+		err := json.Unmarshal(scanner.Bytes(), evt)
+		if err != nil {
+			return errors.Wrapf(err, "error unmarshalling %s event", e.Event)
+		}
+
+		for _, h := range handlers {
+			h.HandleEvent(evt)
+		}
+	}
+
+	return errors.Wrap(scanner.Err(), "error reading events")
+}
+
+// eventQueue buffers events for a component that waits for them on its own
+// goroutine. Events that arrive while the queue is full are dropped rather
+// than blocking the dispatcher.
+type eventQueue struct {
+	events chan interface{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{
+		events: make(chan interface{}, 256),
+	}
+}
+
+// HandleEvent queues the event.
+func (q *eventQueue) HandleEvent(evt interface{}) {
+	select {
+	case q.events <- evt:
+	default:
+	}
+}
+
+// clear discards all queued events, so that a following waitFor only sees
+// events sent after a command is issued.
+func (q *eventQueue) clear() {
+	for {
+		select {
+		case <-q.events:
+		default:
+			return
+		}
+	}
+}
+
+// waitFor waits until match returns true or an error for a queued event, or
+// the context is done.
+func (q *eventQueue) waitFor(ctx context.Context, match func(evt interface{}) (bool, error)) error {
+	for {
+		select {
+		case evt := <-q.events:
+			ok, err := match(evt)
+			if ok || err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitForFrames waits for n frames to be taken while looping.
+func (q *eventQueue) waitForFrames(ctx context.Context, n int) error {
+	frames := 0
+
+	return q.waitFor(ctx, func(evt interface{}) (bool, error) {
+		if _, ok := evt.(*LoopingExposuresEvent); ok {
+			frames++
+		}
+
+		return frames >= n, nil
+	})
+}
+
+// waitForSettle waits for the SettleDone event that ends a guide or dither.
+func (q *eventQueue) waitForSettle(ctx context.Context) error {
+	return q.waitFor(ctx, func(evt interface{}) (bool, error) {
+		done, ok := evt.(*SettleDoneEvent)
+		if !ok {
+			return false, nil
+		}
+
+		if done.Status != 0 {
+			return true, errors.Wrap(ErrSettleFailed, done.Error)
+		}
+
+		return true, nil
+	})
+}
+
+// waitForGuideSettle waits for guiding to settle using the distance in guide
+// steps, for moves that PHD2 does not send settling events for, such as
+// setting the lock position. A zero settle timeout means no time limit.
+func (q *eventQueue) waitForGuideSettle(ctx context.Context, settle Settle) error {
+	if settle.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(settle.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	var inRangeSince float64
+	inRange := false
+
+	err := q.waitFor(ctx, func(evt interface{}) (bool, error) {
+		step, ok := evt.(*GuideStepEvent)
+		if !ok {
+			return false, nil
+		}
+
+		if math.Hypot(step.DX, step.DY) > settle.Pixels {
+			inRange = false
+			return false, nil
+		}
+
+		if !inRange {
+			inRange = true
+			inRangeSince = step.Timestamp
+		}
+
+		return step.Timestamp-inRangeSince >= float64(settle.TimeSeconds), nil
+	})
+	if err == context.DeadlineExceeded {
+		return errors.Wrap(ErrSettleFailed, "timed-out waiting for guider to settle")
+	}
+
+	return err
+}
+
+// collectGuideSteps collects the guide steps sent for a duration. It fails if
+// guiding stops in the meantime.
+func (q *eventQueue) collectGuideSteps(ctx context.Context, d time.Duration) ([]*GuideStepEvent, error) {
+	collectCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	var steps []*GuideStepEvent
+
+	err := q.waitFor(collectCtx, func(evt interface{}) (bool, error) {
+		switch e := evt.(type) {
+		case *GuideStepEvent:
+			steps = append(steps, e)
+		case *GuidingStoppedEvent:
+			return true, errGuidingStopped
+		}
+
+		return false, nil
+	})
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		err = nil
+	}
+
+	return steps, err
+}
@@ -0,0 +1,178 @@
+package phd2
+
+import (
+	"math"
+	"math/rand"
+)
+
+// socketDitherAmounts lists the dither amounts from smallest to largest.
+var socketDitherAmounts = []SocketDitherAmount{
+	SocketDitherAmountTiny,
+	SocketDitherAmountSmall,
+	SocketDitherAmountNormal,
+	SocketDitherAmountLarge,
+	SocketDitherAmountHuge,
+}
+
+// Multiple returns the multiple of the dither scale that the amount dithers
+// by, or 0 if the amount is unknown.
+func (amt SocketDitherAmount) Multiple() float64 {
+	switch amt {
+	case SocketDitherAmountTiny:
+		return 0.5
+	case SocketDitherAmountSmall:
+		return 1.0
+	case SocketDitherAmountNormal:
+		return 2.0
+	case SocketDitherAmountLarge:
+		return 3.0
+	case SocketDitherAmountHuge:
+		return 5.0
+	}
+
+	return 0
+}
+
+// Pixels returns the maximum dither in pixels given the dither scale set in
+// the Brain.
+func (amt SocketDitherAmount) Pixels(ditherScale float64) float64 {
+	return amt.Multiple() * ditherScale
+}
+
+// SocketDitherAmountForPixels returns the dither amount closest to the given
+// number of pixels, given the dither scale set in the Brain.
+func SocketDitherAmountForPixels(pixels, ditherScale float64) SocketDitherAmount {
+	best := socketDitherAmounts[0]
+
+	for _, amt := range socketDitherAmounts[1:] {
+		if math.Abs(amt.Pixels(ditherScale)-pixels) < math.Abs(best.Pixels(ditherScale)-pixels) {
+			best = amt
+		}
+	}
+
+	return best
+}
+
+// Ditherer dithers the guider by up to a number of pixels on each axis. It
+// allows dithers to be expressed in pixels whichever protocol is in use.
+type Ditherer interface {
+	Dither(pixels float64) error
+}
+
+// RPCDitherer is a Ditherer that uses an RPCClient.
+type RPCDitherer struct {
+	c           *RPCClient
+	ditherScale float64
+	raOnly      bool
+	settle      Settle
+}
+
+// NewRPCDitherer creates a new RPCDitherer. The dither scale must match the one
+// set in the Brain; a scale of 0 is taken to be 1.
+func NewRPCDitherer(c *RPCClient, ditherScale float64, raOnly bool, settle Settle) *RPCDitherer {
+	if ditherScale <= 0 {
+		ditherScale = 1
+	}
+
+	return &RPCDitherer{
+		c:           c,
+		ditherScale: ditherScale,
+		raOnly:      raOnly,
+		settle:      settle,
+	}
+}
+
+// Dither dithers by up to the given number of pixels. It does not wait for
+// guiding to settle.
+func (d *RPCDitherer) Dither(pixels float64) error {
+	// PHD2 multiplies the amount by the dither scale.
+	return d.c.Dither(pixels/d.ditherScale, d.raOnly, d.settle)
+}
+
+// SocketDitherer is a Ditherer that uses a SocketClient. The socket protocol
+// only offers five dither amounts, so the closest one is used.
+type SocketDitherer struct {
+	c           *SocketClient
+	ditherScale float64
+}
+
+// NewSocketDitherer creates a new SocketDitherer. The dither scale must match
+// the one set in the Brain; a scale of 0 is taken to be 1.
+func NewSocketDitherer(c *SocketClient, ditherScale float64) *SocketDitherer {
+	if ditherScale <= 0 {
+		ditherScale = 1
+	}
+
+	return &SocketDitherer{
+		c:           c,
+		ditherScale: ditherScale,
+	}
+}
+
+// Dither dithers by the amount closest to the given number of pixels.
+func (d *SocketDitherer) Dither(pixels float64) error {
+	_, err := d.c.Dither(SocketDitherAmountForPixels(pixels, d.ditherScale))
+	return err
+}
+
+// DitherStrategy decides how many pixels to dither by each time.
+type DitherStrategy interface {
+	NextDither() float64
+}
+
+// RandomDitherStrategy dithers by a uniformly random number of pixels within
+// a range.
+type RandomDitherStrategy struct {
+	min  float64
+	max  float64
+	rand *rand.Rand
+}
+
+// NewRandomDitherStrategy creates a new RandomDitherStrategy that dithers
+// between min and max pixels.
+func NewRandomDitherStrategy(min, max float64, seed int64) *RandomDitherStrategy {
+	return &RandomDitherStrategy{
+		min:  min,
+		max:  max,
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// NextDither returns the next number of pixels to dither by.
+func (s *RandomDitherStrategy) NextDither() float64 {
+	return s.min + s.rand.Float64()*(s.max-s.min)
+}
+
+// PatternDitherStrategy dithers by each of a list of pixel amounts in turn,
+// starting over when it reaches the end.
+type PatternDitherStrategy struct {
+	pixels []float64
+	next   int
+}
+
+// NewPatternDitherStrategy creates a new PatternDitherStrategy.
+func NewPatternDitherStrategy(pixels ...float64) *PatternDitherStrategy {
+	return &PatternDitherStrategy{
+		pixels: pixels,
+	}
+}
+
+// NextDither returns the next number of pixels to dither by, or 0 if the
+// pattern is empty.
+func (s *PatternDitherStrategy) NextDither() float64 {
+	if len(s.pixels) == 0 {
+		return 0
+	}
+
+	pixels := s.pixels[s.next]
+	s.next = (s.next + 1) % len(s.pixels)
+
+	return pixels
+}
+
+// DitherWith dithers by the next amount from the strategy, returning the
+// number of pixels requested.
+func DitherWith(d Ditherer, s DitherStrategy) (float64, error) {
+	pixels := s.NextDither()
+	return pixels, d.Dither(pixels)
+}
@@ -0,0 +1,99 @@
+package phd2_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestSocketDitherAmountForPixels(t *testing.T) {
+	type testCase struct {
+		name string
+
+		pixels      float64
+		ditherScale float64
+
+		expectedResult phd2.SocketDitherAmount
+	}
+
+	testCases := []testCase{
+		testCase{
+			name:           "Tiny",
+			pixels:         0.1,
+			ditherScale:    1,
+			expectedResult: phd2.SocketDitherAmountTiny,
+		},
+		testCase{
+			name:           "Normal",
+			pixels:         4.2,
+			ditherScale:    2,
+			expectedResult: phd2.SocketDitherAmountNormal,
+		},
+		testCase{
+			name:           "Large",
+			pixels:         1.4,
+			ditherScale:    0.5,
+			expectedResult: phd2.SocketDitherAmountLarge,
+		},
+		testCase{
+			name:           "Huge",
+			pixels:         50,
+			ditherScale:    1,
+			expectedResult: phd2.SocketDitherAmountHuge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			amt := phd2.SocketDitherAmountForPixels(tc.pixels, tc.ditherScale)
+			assert.Equal(t, tc.expectedResult, amt)
+		})
+	}
+
+	assert.Equal(t, 6.0, phd2.SocketDitherAmountLarge.Pixels(2))
+}
+
+type recordingDitherer struct {
+	pixels []float64
+}
+
+func (d *recordingDitherer) Dither(pixels float64) error {
+	d.pixels = append(d.pixels, pixels)
+	return nil
+}
+
+func TestDitherWith(t *testing.T) {
+	d := &recordingDitherer{}
+	pattern := phd2.NewPatternDitherStrategy(1, 2, 3)
+
+	for i := 0; i < 4; i++ {
+		_, err := phd2.DitherWith(d, pattern)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []float64{1, 2, 3, 1}, d.pixels)
+
+	random := phd2.NewRandomDitherStrategy(2, 4, 1)
+
+	for i := 0; i < 100; i++ {
+		pixels, err := phd2.DitherWith(d, random)
+		require.NoError(t, err)
+		assert.True(t, pixels >= 2 && pixels <= 4)
+	}
+}
+
+func TestRPCDitherer(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	d := phd2.NewRPCDitherer(c, 2, true, phd2.Settle{Pixels: 1.5, TimeSeconds: 10, TimeoutSeconds: 60})
+	require.NoError(t, d.Dither(6))
+
+	dithers := fake.callsTo("dither")
+	require.Len(t, dithers, 1)
+	assert.Equal(t, "3", string(dithers[0].Params[0]))
+	assert.Equal(t, "true", string(dithers[0].Params[1]))
+}
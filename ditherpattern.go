@@ -0,0 +1,226 @@
+package phd2
+
+import (
+	"context"
+	"image"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// DitherPattern generates deterministic dither offsets, in pixels, from the
+// original lock position. Offset is called with i = 0, 1, 2... for each
+// dither in turn.
+type DitherPattern interface {
+	Offset(i int) (dx, dy float64)
+}
+
+// SpiralDitherPattern walks outwards from the origin in a square spiral, one
+// step at a time, so every dither lands on a new point of a regular lattice.
+type SpiralDitherPattern struct {
+	// Step is the lattice spacing in pixels.
+	Step float64
+}
+
+// Offset returns the offset of the i-th dither.
+func (p SpiralDitherPattern) Offset(i int) (float64, float64) {
+	x, y := spiralPoint(i + 1)
+	return float64(x) * p.Step, float64(y) * p.Step
+}
+
+// spiralPoint returns the n-th point of a square spiral around the origin,
+// where point 0 is the origin itself.
+func spiralPoint(n int) (int, int) {
+	if n == 0 {
+		return 0, 0
+	}
+
+	// Ring k holds the 8k points with max(|x|, |y|) = k, which follow the
+	// (2k-1)^2 points of the rings inside it.
+	k := int(math.Ceil((math.Sqrt(float64(n+1)) - 1) / 2))
+	side := 2 * k
+	pos := n - (2*k-1)*(2*k-1)
+
+	switch {
+	case pos < side: // Up the right side.
+		return k, -k + 1 + pos
+	case pos < 2*side: // Leftwards along the top.
+		return k - 1 - (pos - side), k
+	case pos < 3*side: // Down the left side.
+		return -k, k - 1 - (pos - 2*side)
+	default: // Rightwards along the bottom.
+		return -k + 1 + (pos - 3*side), -k
+	}
+}
+
+// GridDitherPattern visits each point of a grid centred on the origin in turn,
+// row by row in alternating directions, and then starts over.
+type GridDitherPattern struct {
+	Columns int
+	Rows    int
+	// Step is the grid spacing in pixels.
+	Step float64
+}
+
+// Offset returns the offset of the i-th dither.
+func (p GridDitherPattern) Offset(i int) (float64, float64) {
+	if p.Columns <= 0 || p.Rows <= 0 {
+		return 0, 0
+	}
+
+	i %= p.Columns * p.Rows
+	row := i / p.Columns
+	col := i % p.Columns
+
+	if row%2 == 1 {
+		col = p.Columns - 1 - col
+	}
+
+	dx := (float64(col) - float64(p.Columns-1)/2) * p.Step
+	dy := (float64(row) - float64(p.Rows-1)/2) * p.Step
+
+	return dx, dy
+}
+
+// HaltonDitherPattern spreads dithers evenly but irregularly over a square
+// using the base 2 and base 3 Halton sequences, which avoids the periodic
+// artefacts a lattice can leave in drizzled stacks.
+type HaltonDitherPattern struct {
+	// Radius is half the width of the square in pixels.
+	Radius float64
+}
+
+// Offset returns the offset of the i-th dither.
+func (p HaltonDitherPattern) Offset(i int) (float64, float64) {
+	// Index 0 of the sequence is the corner of the square, so skip it.
+	return (2*halton(i+1, 2) - 1) * p.Radius, (2*halton(i+1, 3) - 1) * p.Radius
+}
+
+// halton returns the i-th element of the Halton sequence for a base, in [0, 1).
+func halton(i, base int) float64 {
+	result := 0.0
+	f := 1.0
+
+	for i > 0 {
+		f /= float64(base)
+		result += f * float64(i%base)
+		i /= base
+	}
+
+	return result
+}
+
+// DitherPlannerConfig configures a DitherPlanner.
+type DitherPlannerConfig struct {
+	Pattern DitherPattern
+	// Frame is the camera frame. Lock positions are kept at least Margin
+	// pixels inside it. An empty frame disables the check.
+	Frame  image.Rectangle
+	Margin float64
+	// Settle decides when guiding has settled after each move, judged from
+	// the distance reported in guide steps.
+	Settle Settle
+}
+
+// DitherPlanner dithers deterministically by moving the lock position to
+// offsets generated by a DitherPattern around the original lock position,
+// rather than by PHD2's random dither.
+//
+// DitherPlanner must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type DitherPlanner struct {
+	c      *RPCClient
+	config DitherPlannerConfig
+	queue  *eventQueue
+
+	origin *LockPosition
+	next   int
+}
+
+// NewDitherPlanner creates a new DitherPlanner.
+func NewDitherPlanner(c *RPCClient, config DitherPlannerConfig) *DitherPlanner {
+	return &DitherPlanner{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent queues events for settling.
+func (p *DitherPlanner) HandleEvent(evt interface{}) {
+	p.queue.HandleEvent(evt)
+}
+
+// Origin returns the original lock position, or nil if no dither has been made
+// yet.
+func (p *DitherPlanner) Origin() *LockPosition {
+	return p.origin
+}
+
+// Next moves the lock position to the next offset of the pattern and waits
+// for guiding to settle. The original lock position is read from PHD2 the
+// first time. It returns the new lock position.
+func (p *DitherPlanner) Next(ctx context.Context) (float64, float64, error) {
+	if p.origin == nil {
+		origin, err := p.c.GetLockPositionF()
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "error getting lock position")
+		}
+
+		if origin == nil {
+			return 0, 0, errors.New("no lock position to dither around")
+		}
+
+		p.origin = origin
+	}
+
+	dx, dy := p.config.Pattern.Offset(p.next)
+	p.next++
+
+	x, y := p.clamp(p.origin.X+dx, p.origin.Y+dy)
+
+	return x, y, p.move(ctx, x, y)
+}
+
+// ReturnToOrigin moves the lock position back to the original lock position
+// and waits for guiding to settle. The pattern starts over afterwards.
+func (p *DitherPlanner) ReturnToOrigin(ctx context.Context) error {
+	if p.origin == nil {
+		return nil
+	}
+
+	err := p.move(ctx, p.origin.X, p.origin.Y)
+	if err != nil {
+		return err
+	}
+
+	p.origin = nil
+	p.next = 0
+
+	return nil
+}
+
+func (p *DitherPlanner) clamp(x, y float64) (float64, float64) {
+	frame := p.config.Frame
+	if frame.Empty() {
+		return x, y
+	}
+
+	m := p.config.Margin
+
+	x = math.Max(float64(frame.Min.X)+m, math.Min(float64(frame.Max.X)-m, x))
+	y = math.Max(float64(frame.Min.Y)+m, math.Min(float64(frame.Max.Y)-m, y))
+
+	return x, y
+}
+
+func (p *DitherPlanner) move(ctx context.Context, x, y float64) error {
+	p.queue.clear()
+
+	err := p.c.SetLockPosition(x, y, true)
+	if err != nil {
+		return errors.Wrap(err, "error setting lock position")
+	}
+
+	return p.queue.waitForGuideSettle(ctx, p.config.Settle)
+}
@@ -0,0 +1,91 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+type offset struct {
+	dx, dy float64
+}
+
+func offsets(p phd2.DitherPattern, n int) []offset {
+	var result []offset
+	for i := 0; i < n; i++ {
+		dx, dy := p.Offset(i)
+		result = append(result, offset{dx, dy})
+	}
+	return result
+}
+
+func TestDitherPatterns(t *testing.T) {
+	assert.Equal(t, []offset{
+		{2, 0}, {2, 2}, {0, 2}, {-2, 2}, {-2, 0}, {-2, -2}, {0, -2}, {2, -2}, {4, -2},
+	}, offsets(phd2.SpiralDitherPattern{Step: 2}, 9))
+
+	assert.Equal(t, []offset{
+		{-1, -0.5}, {0, -0.5}, {1, -0.5}, {1, 0.5}, {0, 0.5}, {-1, 0.5}, {-1, -0.5},
+	}, offsets(phd2.GridDitherPattern{Columns: 3, Rows: 2, Step: 1}, 7))
+
+	halton := offsets(phd2.HaltonDitherPattern{Radius: 5}, 50)
+	assert.InDelta(t, 0, halton[0].dx, 1e-9)
+	assert.InDelta(t, -5.0/3, halton[0].dy, 1e-9)
+
+	seen := make(map[offset]bool)
+	for _, o := range halton {
+		assert.True(t, o.dx >= -5 && o.dx < 5 && o.dy >= -5 && o.dy < 5)
+		assert.False(t, seen[o])
+		seen[o] = true
+	}
+}
+
+func TestDitherPlanner(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	p := phd2.NewDitherPlanner(c, phd2.DitherPlannerConfig{
+		Pattern: phd2.SpiralDitherPattern{Step: 10},
+		Frame:   image.Rect(0, 0, 120, 120),
+		Margin:  15,
+		Settle:  phd2.Settle{Pixels: 0.5, TimeSeconds: 0, TimeoutSeconds: 10},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, p)
+
+	fake.result("get_lock_position", []float64{100.5, 60.25})
+	fake.handle("set_lock_position", func([]json.RawMessage) (interface{}, error) {
+		go func() {
+			fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}, DX: 3})
+			fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}, DX: 0.2})
+		}()
+		return 0, nil
+	})
+
+	x, y, err := p.Next(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 105.0, x, "clamped to the frame")
+	assert.Equal(t, 60.25, y)
+
+	x, y, err = p.Next(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 105.0, x)
+	assert.Equal(t, 70.25, y)
+
+	require.NoError(t, p.ReturnToOrigin(context.Background()))
+	assert.Nil(t, p.Origin())
+
+	locks := fake.callsTo("set_lock_position")
+	require.Len(t, locks, 3)
+	assert.Equal(t, "100.5", string(locks[2].Params[0]))
+	assert.Equal(t, "60.25", string(locks[2].Params[1]))
+	assert.Equal(t, "true", string(locks[2].Params[2]))
+}
@@ -14,4 +14,10 @@ const (
 	// ErrNotConnected is returned if the client is not connected to the PHD2
 	// server.
 	ErrNotConnected = Error("not connected")
+	// ErrSettleFailed is returned if PHD2 reports that guiding failed to
+	// settle after a guide or dither.
+	ErrSettleFailed = Error("settling failed")
+	// ErrTimeout is returned if an operation did not complete within its time
+	// limit.
+	ErrTimeout = Error("timed out")
 )
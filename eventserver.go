@@ -0,0 +1,571 @@
+package phd2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JSON-RPC error codes used by EventServer.
+const (
+	rpcErrorCodeInvalidParams  = -32602
+	rpcErrorCodeMethodNotFound = -32601
+	rpcErrorCodeFailed         = 1
+)
+
+// eventServerConnBuffer is how many messages may be waiting to be written to a
+// connection before it is considered too slow and dropped.
+const eventServerConnBuffer = 256
+
+// EventServer emulates the PHD2 event server for PHD builds that only provide
+// the legacy socket interface. It answers the subset of JSON-RPC methods that
+// can be carried out with a SocketClient and synthesizes AppState,
+// StartGuiding, StarLost, settling and other events from polled status, so that
+// an RPCClient can manage old and new rigs alike.
+//
+// Run must be running for events to be sent and for guide and dither to
+// settle. Events that need information the socket protocol does not provide,
+// such as GuideStep and StarSelected, are never sent.
+type EventServer struct {
+	c       *SocketClient
+	watcher *SocketWatcher
+	host    string
+
+	mutex   sync.Mutex
+	conns   map[*eventServerConn]struct{}
+	status  SocketStatus
+	guiding bool
+	settle  *emulatedSettle
+}
+
+// eventServerConn is a connection to an RPC client. Messages are written by
+// their own goroutine so a slow client does not hold up the others.
+type eventServerConn struct {
+	conn net.Conn
+	out  chan []byte
+}
+
+// emulatedSettle tracks an in-progress guide or dither until it settles.
+type emulatedSettle struct {
+	settle Settle
+	// started is when guiding was first seen, the zero time until then.
+	started      time.Time
+	inRangeSince time.Time
+	frames       int
+}
+
+// NewEventServer creates a new EventServer that polls the SocketClient every
+// interval.
+func NewEventServer(c *SocketClient, interval time.Duration) *EventServer {
+	host, _ := os.Hostname()
+
+	return &EventServer{
+		c:       c,
+		watcher: NewSocketWatcher(c, interval),
+		host:    host,
+		conns:   make(map[*eventServerConn]struct{}),
+	}
+}
+
+// Run polls PHD2 and sends the synthesized events to all connected clients
+// until the context is done or polling fails.
+func (s *EventServer) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan interface{})
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.watcher.Run(ctx, events)
+	}()
+
+	for {
+		select {
+		case evt := <-events:
+			s.handleSocketEvent(evt)
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+// Serve accepts connections on the listener and serves each one on its own
+// goroutine. It returns when the listener fails, e.g. because it was closed.
+func (s *EventServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return errors.Wrap(err, "error accepting connection")
+		}
+
+		go func() {
+			_ = s.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn serves JSON-RPC requests from a single connection, and sends it
+// events, until it is closed. The connection is closed when ServeConn returns.
+func (s *EventServer) ServeConn(conn net.Conn) error {
+	ec := &eventServerConn{
+		conn: conn,
+		out:  make(chan []byte, eventServerConnBuffer),
+	}
+
+	go ec.write()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, ec)
+		s.mutex.Unlock()
+
+		// The connection is no longer broadcast to, so nothing else sends.
+		close(ec.out)
+		conn.Close()
+	}()
+
+	err := s.greet(ec)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var req struct {
+			Method string            `json:"method"`
+			ID     int               `json:"id"`
+			Params []json.RawMessage `json:"params"`
+		}
+
+		resp := rpcResponse{}
+
+		err = json.Unmarshal(line, &req)
+		if err != nil {
+			resp.Error = &rpcError{Code: rpcErrorCodeInvalidParams, Message: "invalid request"}
+		} else {
+			resp.ID = req.ID
+			resp.Result, resp.Error = s.call(req.Method, req.Params)
+		}
+
+		err = ec.send(struct {
+			JSONRPC string `json:"jsonrpc"`
+			rpcResponse
+		}{
+			JSONRPC:     "2.0",
+			rpcResponse: resp,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(scanner.Err(), "error reading request")
+}
+
+// greet sends the version and app state to a new connection, like PHD2 does,
+// and then starts sending it events.
+func (s *EventServer) greet(ec *eventServerConn) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := ec.send(&VersionEvent{
+		Event:      s.event("Version"),
+		PHDVersion: "socket",
+		MsgVersion: 1,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ec.send(&AppStateEvent{
+		Event: s.event("AppState"),
+		State: string(AppStateFromSocketStatus(s.status)),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.conns[ec] = struct{}{}
+
+	return nil
+}
+
+// send queues a message to be written, waiting for room if the connection is
+// behind. Write errors close the connection, which ServeConn notices when
+// reading the next request.
+func (ec *eventServerConn) send(msg interface{}) error {
+	bytes, err := marshalMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	ec.out <- bytes
+
+	return nil
+}
+
+// write writes queued messages until the queue is closed. After a write fails
+// the connection is closed and the rest of the queue is discarded.
+func (ec *eventServerConn) write() {
+	var err error
+
+	for bytes := range ec.out {
+		if err != nil {
+			continue
+		}
+
+		_, err = ec.conn.Write(bytes)
+		if err != nil {
+			ec.conn.Close()
+		}
+	}
+}
+
+func marshalMessage(msg interface{}) ([]byte, error) {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshalling message")
+	}
+
+	return append(bytes, '\r', '\n'), nil
+}
+
+func (s *EventServer) event(name string) Event {
+	now := time.Now()
+
+	return Event{
+		Event:     name,
+		Timestamp: float64(now.UnixNano()) / float64(time.Second),
+		Host:      s.host,
+		Inst:      1,
+	}
+}
+
+// broadcast queues the events for all connected clients without waiting for
+// them to be written. A client that has fallen too far behind is dropped rather
+// than holding up the others. The mutex must be held.
+func (s *EventServer) broadcast(events ...interface{}) {
+	var msgs [][]byte
+	for _, evt := range events {
+		bytes, err := marshalMessage(evt)
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, bytes)
+	}
+
+	for ec := range s.conns {
+		for _, bytes := range msgs {
+			select {
+			case ec.out <- bytes:
+				continue
+			default:
+			}
+
+			// ServeConn will notice the closed connection and finish up.
+			delete(s.conns, ec)
+			ec.conn.Close()
+			break
+		}
+	}
+}
+
+func (s *EventServer) handleSocketEvent(evt interface{}) { // nolint: gocyclo
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var events []interface{}
+
+	switch e := evt.(type) {
+	case *SocketInitialStatusEvent:
+		s.status = e.Status
+		s.guiding = isGuidingSocketStatus(e.Status)
+		events = append(events, &AppStateEvent{
+			Event: s.event("AppState"),
+			State: string(AppStateFromSocketStatus(e.Status)),
+		})
+	case *SocketStatusChangedEvent:
+		s.status = e.Status
+		events = append(events, &AppStateEvent{
+			Event: s.event("AppState"),
+			State: string(AppStateFromSocketStatus(e.Status)),
+		})
+
+		if e.Previous == SocketStatusCalibrating && e.Status != SocketStatusCalibrating {
+			if e.Status == SocketStatusGuiding {
+				events = append(events, &CalibrationCompleteEvent{Event: s.event("CalibrationComplete"), Mount: "Mount"})
+			} else {
+				events = append(events, &CalibrationFailedEvent{Event: s.event("CalibrationFailed")})
+			}
+		}
+
+		// Pausing does not stop guiding, and the status while paused does not
+		// say whether PHD2 was guiding, so remember it.
+		if isGuidingSocketStatus(e.Status) {
+			s.guiding = true
+		} else if s.guiding && e.Status != SocketStatusPaused {
+			s.guiding = false
+			events = append(events, &GuidingStoppedEvent{Event: s.event("GuidingStopped")})
+			events = append(events, s.settleDone("guiding stopped")...)
+		}
+	case *SocketStoppedEvent:
+		events = append(events, &LoopingExposuresStoppedEvent{Event: s.event("LoopingExposuresStopped")})
+	case *SocketCalibrationStartedEvent:
+		events = append(events, &StartCalibrationEvent{Event: s.event("StartCalibration"), Mount: "Mount"})
+	case *SocketGuidingStartedEvent:
+		events = append(events, &StartGuidingEvent{Event: s.event("StartGuiding")})
+	case *SocketStarLostEvent:
+		events = append(events, &StarLostEvent{Event: s.event("StarLost"), Status: "star lost"})
+	case *SocketPausedEvent:
+		events = append(events, &PausedEvent{Event: s.event("Paused")})
+	case *SocketResumedEvent:
+		events = append(events, &ResumedEvent{Event: s.event("Resumed")})
+	case *SocketFrameEvent:
+		switch e.Status {
+		case SocketStatusLooping, SocketStatusStarSelected:
+			events = append(events, &LoopingExposuresEvent{Event: s.event("LoopingExposures"), Frame: int(e.Frame)})
+		}
+
+		events = append(events, s.settleFrame(e)...)
+	}
+
+	s.broadcast(events...)
+}
+
+func isGuidingSocketStatus(status SocketStatus) bool {
+	return status == SocketStatusGuiding || status == SocketStatusStarLost
+}
+
+// settleFrame advances an in-progress settle with a new frame. The mutex must
+// be held.
+func (s *EventServer) settleFrame(frame *SocketFrameEvent) []interface{} {
+	st := s.settle
+	if st == nil || !isGuidingSocketStatus(frame.Status) {
+		return nil
+	}
+
+	if st.started.IsZero() {
+		st.started = frame.Time
+	}
+
+	st.frames++
+
+	// Distances are capped at 2.55 pixels, so a capped reading is never in
+	// range.
+	inRange := frame.Status == SocketStatusGuiding && frame.Distance <= st.settle.Pixels && frame.Distance < 2.55
+
+	if !inRange {
+		st.inRangeSince = time.Time{}
+	} else if st.inRangeSince.IsZero() {
+		st.inRangeSince = frame.Time
+	}
+
+	var settleTime time.Duration
+	if inRange {
+		settleTime = frame.Time.Sub(st.inRangeSince)
+	}
+
+	events := []interface{}{
+		&SettlingEvent{
+			Event:      s.event("Settling"),
+			Distance:   frame.Distance,
+			Time:       frame.Time.Sub(st.started).Seconds(),
+			SettleTime: st.settle.TimeSeconds,
+			StarLocked: frame.Status == SocketStatusGuiding,
+		},
+	}
+
+	if inRange && settleTime >= time.Duration(st.settle.TimeSeconds)*time.Second {
+		return append(events, s.settleDone("")...)
+	}
+
+	// A timeout of 0 means wait for as long as it takes.
+	if st.settle.TimeoutSeconds > 0 && frame.Time.Sub(st.started) >= time.Duration(st.settle.TimeoutSeconds)*time.Second {
+		return append(events, s.settleDone("timed-out waiting for guider to settle")...)
+	}
+
+	return events
+}
+
+// settleDone finishes an in-progress settle, successfully if reason is empty.
+// The mutex must be held.
+func (s *EventServer) settleDone(reason string) []interface{} {
+	st := s.settle
+	if st == nil {
+		return nil
+	}
+
+	s.settle = nil
+
+	evt := &SettleDoneEvent{
+		Event:       s.event("SettleDone"),
+		TotalFrames: st.frames,
+	}
+
+	if reason != "" {
+		evt.Status = 1
+		evt.Error = reason
+	}
+
+	return []interface{}{evt}
+}
+
+// beginSettle starts tracking a guide or dither until it settles.
+func (s *EventServer) beginSettle(settle Settle) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	events := s.settleDone("cancelled by a new guide or dither request")
+
+	s.settle = &emulatedSettle{settle: settle}
+
+	s.broadcast(append(events, &SettleBeginEvent{Event: s.event("SettleBegin")})...)
+}
+
+func (s *EventServer) call(method string, params []json.RawMessage) (json.RawMessage, *rpcError) { // nolint: gocyclo
+	var result interface{} = 0
+	var err error
+
+	switch method {
+	case "get_app_state":
+		var status SocketStatus
+		status, err = s.c.GetStatus()
+		result = AppStateFromSocketStatus(status)
+	case "get_paused":
+		var status SocketStatus
+		status, err = s.c.GetStatus()
+		result = status == SocketStatusPaused
+	case "get_connected":
+		// The socket protocol cannot tell whether the equipment is
+		// connected, so report whether PHD2 itself can be reached.
+		_, statusErr := s.c.GetStatus()
+		result = statusErr == nil
+	case "set_paused":
+		var paused bool
+		if len(params) < 1 || json.Unmarshal(params[0], &paused) != nil {
+			return nil, &rpcError{Code: rpcErrorCodeInvalidParams, Message: "expected paused param"}
+		}
+		if paused {
+			err = s.c.Pause()
+		} else {
+			err = s.c.Resume()
+		}
+	case "loop":
+		var started bool
+		started, err = s.c.Loop()
+		if err == nil && !started {
+			err = errors.New("could not start looping")
+		}
+	case "stop_capture":
+		err = s.c.Stop()
+	case "find_star":
+		// The socket protocol does not report the star position.
+		var found bool
+		found, err = s.c.AutoFindStar()
+		if err == nil && !found {
+			err = errors.New("could not find a suitable guide star")
+		}
+		result = nil
+	case "clear_calibration":
+		err = s.c.ClearCalibration()
+	case "flip_calibration":
+		var flipped bool
+		flipped, err = s.c.FlipRACalibrationData()
+		if err == nil && !flipped {
+			err = errors.New("could not flip calibration")
+		}
+	case "guide":
+		var settle Settle
+		var recalibrate bool
+		if len(params) < 1 || json.Unmarshal(params[0], &settle) != nil {
+			return nil, &rpcError{Code: rpcErrorCodeInvalidParams, Message: "expected settle param"}
+		}
+		if len(params) > 1 && json.Unmarshal(params[1], &recalibrate) != nil {
+			return nil, &rpcError{Code: rpcErrorCodeInvalidParams, Message: "expected recalibrate param"}
+		}
+		err = s.guide(settle, recalibrate)
+	case "dither":
+		var pixels float64
+		var settle Settle
+		if len(params) < 1 || json.Unmarshal(params[0], &pixels) != nil {
+			return nil, &rpcError{Code: rpcErrorCodeInvalidParams, Message: "expected amount param"}
+		}
+		// The socket protocol cannot restrict a dither to RA, so params[1]
+		// is ignored.
+		if len(params) > 2 && json.Unmarshal(params[2], &settle) != nil {
+			return nil, &rpcError{Code: rpcErrorCodeInvalidParams, Message: "expected settle param"}
+		}
+		// Both protocols multiply the amount by the dither scale set in the
+		// Brain, so the amount is converted with a scale of 1.
+		_, err = s.c.Dither(SocketDitherAmountForPixels(pixels, 1))
+		if err == nil {
+			s.beginSettle(settle)
+		}
+	default:
+		return nil, &rpcError{Code: rpcErrorCodeMethodNotFound, Message: fmt.Sprintf("method not found: %s", method)}
+	}
+
+	if err != nil {
+		return nil, &rpcError{Code: rpcErrorCodeFailed, Message: err.Error()}
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, &rpcError{Code: rpcErrorCodeFailed, Message: err.Error()}
+	}
+
+	return bytes, nil
+}
+
+func (s *EventServer) guide(settle Settle, recalibrate bool) error {
+	if recalibrate {
+		err := s.c.ClearCalibration()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.c.StartGuiding()
+	if err != nil {
+		return err
+	}
+
+	s.beginSettle(settle)
+
+	return nil
+}
+
+// AppStateFromSocketStatus returns the RPC app state that corresponds to a
+// socket status.
+func AppStateFromSocketStatus(status SocketStatus) AppState {
+	switch status {
+	case SocketStatusStarSelected:
+		return AppStateSelected
+	case SocketStatusCalibrating:
+		return AppStateCalibrating
+	case SocketStatusGuiding:
+		return AppStateGuiding
+	case SocketStatusStarLost:
+		return AppStateLostLock
+	case SocketStatusPaused:
+		return AppStatePaused
+	case SocketStatusLooping:
+		return AppStateLooping
+	}
+
+	return AppStateStopped
+}
@@ -0,0 +1,172 @@
+package phd2_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+// nextEventOfType reads events until one of the same type as example arrives.
+func nextEventOfType(t *testing.T, events <-chan interface{}, example interface{}) interface{} {
+	timeout := time.After(time.Second)
+
+	for {
+		select {
+		case evt := <-events:
+			if reflect.TypeOf(evt) == reflect.TypeOf(example) {
+				return evt
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %T", example)
+			return nil
+		}
+	}
+}
+
+func TestEventServer(t *testing.T) {
+	sockClient, sockServer := net.Pipe()
+	defer sockServer.Close()
+
+	fake := &fakeSocketPHD2{}
+	go fake.serve(sockServer)
+
+	sc := phd2.NewSocketClient(&pipeDialer{conn: sockClient})
+	require.NoError(t, sc.Connect("127.0.0.1", 4300))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := phd2.NewEventServer(sc, time.Millisecond)
+	go func() {
+		_ = server.Run(ctx)
+	}()
+
+	rpcClient, rpcServer := net.Pipe()
+	go func() {
+		_ = server.ServeConn(rpcServer)
+	}()
+
+	c := phd2.NewRPCClient(&pipeDialer{conn: rpcClient})
+	require.NoError(t, c.Connect("127.0.0.1", 4400))
+
+	subscription, err := c.Subscribe()
+	require.NoError(t, err)
+
+	events := make(chan interface{}, 100)
+	go phd2.DispatchEvents(subscription, phd2.EventHandlerFunc(func(evt interface{}) {
+		events <- evt
+	}))
+
+	state, err := c.GetAppState()
+	require.NoError(t, err)
+	assert.Equal(t, phd2.AppStateStopped, state)
+
+	connected, err := c.GetConnected()
+	require.NoError(t, err)
+	assert.True(t, connected)
+
+	settle := phd2.Settle{Pixels: 1, TimeSeconds: 0, TimeoutSeconds: 10}
+
+	require.NoError(t, c.Guide(settle, false))
+	assert.Equal(t, []byte{20}, fake.received())
+	nextEventOfType(t, events, &phd2.SettleBeginEvent{})
+
+	fake.set(phd2.SocketStatusGuiding, 0, 50)
+	nextEventOfType(t, events, &phd2.StartGuidingEvent{})
+
+	fake.set(phd2.SocketStatusGuiding, 1, 50)
+
+	settling := nextEventOfType(t, events, &phd2.SettlingEvent{}).(*phd2.SettlingEvent)
+	assert.InDelta(t, 0.5, settling.Distance, 1e-9)
+
+	done := nextEventOfType(t, events, &phd2.SettleDoneEvent{}).(*phd2.SettleDoneEvent)
+	assert.Equal(t, 0, done.Status)
+
+	// A timeout of 0 waits until guiding stops.
+	require.NoError(t, c.Dither(2.2, false, phd2.Settle{Pixels: 0.1}))
+	assert.Equal(t, []byte{20, byte(phd2.SocketDitherAmountNormal)}, fake.received())
+
+	fake.set(phd2.SocketStatusGuiding, 2, 50)
+	nextEventOfType(t, events, &phd2.SettlingEvent{})
+
+	fake.set(phd2.SocketStatusIdle, 0, 0)
+	nextEventOfType(t, events, &phd2.GuidingStoppedEvent{})
+	done = nextEventOfType(t, events, &phd2.SettleDoneEvent{}).(*phd2.SettleDoneEvent)
+	assert.Equal(t, 1, done.Status)
+	assert.Equal(t, "guiding stopped", done.Error)
+
+	_, err = c.GetPixelScale()
+	assert.Error(t, err)
+
+	sockServer.Close()
+	connected, err = c.GetConnected()
+	require.NoError(t, err)
+	assert.False(t, connected)
+}
+
+func TestEventServerSlowClient(t *testing.T) {
+	sockClient, sockServer := net.Pipe()
+	defer sockServer.Close()
+
+	fake := &fakeSocketPHD2{}
+	go fake.serve(sockServer)
+
+	sc := phd2.NewSocketClient(&pipeDialer{conn: sockClient})
+	require.NoError(t, sc.Connect("127.0.0.1", 4300))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := phd2.NewEventServer(sc, time.Millisecond)
+	go func() {
+		_ = server.Run(ctx)
+	}()
+
+	// The slow client never reads, so writes to it never complete.
+	slowClient, slowServer := net.Pipe()
+	defer slowClient.Close()
+	go func() {
+		_ = server.ServeConn(slowServer)
+	}()
+
+	rpcClient, rpcServer := net.Pipe()
+	go func() {
+		_ = server.ServeConn(rpcServer)
+	}()
+
+	c := phd2.NewRPCClient(&pipeDialer{conn: rpcClient})
+	require.NoError(t, c.Connect("127.0.0.1", 4400))
+
+	subscription, err := c.Subscribe()
+	require.NoError(t, err)
+
+	events := make(chan interface{}, 100)
+	go phd2.DispatchEvents(subscription, phd2.EventHandlerFunc(func(evt interface{}) {
+		events <- evt
+	}))
+
+	_, err = c.GetAppState()
+	require.NoError(t, err)
+
+	// Start looping first, so no poll sees a frame before the status.
+	fake.set(phd2.SocketStatusLooping, 0, 0)
+	for {
+		evt := nextEventOfType(t, events, &phd2.AppStateEvent{}).(*phd2.AppStateEvent)
+		if evt.State == string(phd2.AppStateLooping) {
+			break
+		}
+	}
+
+	for frame := uint8(1); frame <= 20; frame++ {
+		fake.set(phd2.SocketStatusLooping, frame, 0)
+		evt := nextEventOfType(t, events, &phd2.LoopingExposuresEvent{}).(*phd2.LoopingExposuresEvent)
+		assert.Equal(t, int(frame), evt.Frame)
+	}
+}
@@ -0,0 +1,234 @@
+package phd2
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExposureControllerConfig configures an ExposureController.
+type ExposureControllerConfig struct {
+	// MinSNR and MaxSNR are the band the star's SNR is kept within. They
+	// default to 15 and 60.
+	MinSNR float64
+	MaxSNR float64
+	// MinExposure and MaxExposure limit the exposures chosen. Zero means no
+	// limit beyond the exposures PHD2 offers.
+	MinExposure time.Duration
+	MaxExposure time.Duration
+	// Frames is how many guide steps are averaged before deciding on a change.
+	// Defaults to 5.
+	Frames int
+	// Holdoff is how many guide steps to ignore after a change, as the frame
+	// being exposed when it was made still has the old exposure. Defaults to
+	// 1.
+	Holdoff int
+
+	// OnChange, if set, is called for every exposure change. It is called
+	// from the goroutine running Run.
+	OnChange func(ExposureChange)
+}
+
+// ExposureChange describes an exposure change made by an ExposureController.
+type ExposureChange struct {
+	From time.Duration
+	To   time.Duration
+	// SNR and StarMass are the averages that led to the change.
+	SNR      float64
+	StarMass float64
+	Time     time.Time
+}
+
+// ExposureController steps the guide exposure up or down among the exposures
+// PHD2 offers to keep the star's SNR within a band. It waits for several guide
+// steps at an exposure before deciding, ignores guide steps while settling and
+// does not make a change that it predicts would take the SNR out of the other
+// side of the band, so that it does not oscillate.
+//
+// ExposureController must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type ExposureController struct {
+	c      *RPCClient
+	config ExposureControllerConfig
+	queue  *eventQueue
+
+	mutex    sync.Mutex
+	exposure time.Duration
+}
+
+// NewExposureController creates a new ExposureController.
+func NewExposureController(c *RPCClient, config ExposureControllerConfig) *ExposureController {
+	if config.MinSNR <= 0 {
+		config.MinSNR = 15
+	}
+
+	if config.MaxSNR <= 0 {
+		config.MaxSNR = 60
+	}
+
+	if config.Frames <= 0 {
+		config.Frames = 5
+	}
+
+	if config.Holdoff <= 0 {
+		config.Holdoff = 1
+	}
+
+	return &ExposureController{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent queues events for Run.
+func (e *ExposureController) HandleEvent(evt interface{}) {
+	e.queue.HandleEvent(evt)
+}
+
+// Exposure returns the current exposure.
+func (e *ExposureController) Exposure() time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.exposure
+}
+
+// Run controls the exposure until the context is done or changing the
+// exposure fails.
+func (e *ExposureController) Run(ctx context.Context) error {
+	durations, err := e.c.GetExposureDurations()
+	if err != nil {
+		return errors.Wrap(err, "error getting exposure durations")
+	}
+
+	var allowed []time.Duration
+	for _, d := range durations {
+		if d <= 0 || d < e.config.MinExposure || (e.config.MaxExposure > 0 && d > e.config.MaxExposure) {
+			continue
+		}
+
+		allowed = append(allowed, d)
+	}
+
+	if len(allowed) == 0 {
+		return errors.New("no exposure durations within the limits")
+	}
+
+	sort.Slice(allowed, func(i, j int) bool { return allowed[i] < allowed[j] })
+
+	exposure, err := e.c.GetExposure()
+	if err != nil {
+		return errors.Wrap(err, "error getting exposure")
+	}
+
+	e.setExposure(exposure)
+
+	var snr, mass []float64
+	settling := false
+	holdoff := 0
+
+	return e.queue.waitFor(ctx, func(evt interface{}) (bool, error) {
+		switch ev := evt.(type) {
+		case *StartGuidingEvent, *StarLostEvent:
+			snr, mass = nil, nil
+		case *SettleBeginEvent, *GuidingDitheredEvent:
+			settling = true
+			snr, mass = nil, nil
+		case *SettleDoneEvent:
+			settling = false
+		case *GuideStepEvent:
+			if settling || ev.StarMass <= 0 {
+				return false, nil
+			}
+
+			if holdoff > 0 {
+				holdoff--
+				return false, nil
+			}
+
+			snr = append(snr, ev.SNR)
+			mass = append(mass, ev.StarMass)
+
+			if len(snr) < e.config.Frames {
+				return false, nil
+			}
+
+			change := ExposureChange{
+				From:     e.Exposure(),
+				SNR:      mean(snr),
+				StarMass: mean(mass),
+			}
+			snr, mass = nil, nil
+
+			change.To = e.next(allowed, change.From, change.SNR)
+			if change.To == change.From {
+				return false, nil
+			}
+
+			err := e.c.SetExposure(change.To)
+			if err != nil {
+				return true, errors.Wrap(err, "error setting exposure")
+			}
+
+			e.setExposure(change.To)
+			holdoff = e.config.Holdoff
+
+			if e.config.OnChange != nil {
+				change.Time = time.Now()
+				e.config.OnChange(change)
+			}
+		}
+
+		return false, nil
+	})
+}
+
+func (e *ExposureController) setExposure(exposure time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.exposure = exposure
+}
+
+// next returns the exposure to change to, or the current exposure. The SNR is
+// taken to grow in proportion with the exposure, which overestimates the change
+// when the sky background dominates and so errs on the side of not changing.
+// Auto exposure, reported as 0, is left alone.
+func (e *ExposureController) next(allowed []time.Duration, current time.Duration, snr float64) time.Duration {
+	if current <= 0 {
+		return current
+	}
+
+	i := sort.Search(len(allowed), func(i int) bool { return allowed[i] >= current })
+
+	switch {
+	case snr < e.config.MinSNR && i < len(allowed):
+		next := allowed[i]
+		if next == current {
+			if i+1 == len(allowed) {
+				return current
+			}
+			next = allowed[i+1]
+		}
+
+		if snr*float64(next)/float64(current) > e.config.MaxSNR {
+			return current
+		}
+
+		return next
+	case snr > e.config.MaxSNR && i > 0:
+		next := allowed[i-1]
+
+		if snr*float64(next)/float64(current) < e.config.MinSNR {
+			return current
+		}
+
+		return next
+	}
+
+	return current
+}
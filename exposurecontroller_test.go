@@ -0,0 +1,73 @@
+package phd2_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestExposureController(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	changes := make(chan phd2.ExposureChange, 10)
+	e := phd2.NewExposureController(c, phd2.ExposureControllerConfig{
+		MaxExposure: 2 * time.Second,
+		OnChange: func(change phd2.ExposureChange) {
+			changes <- change
+		},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, e)
+
+	fake.result("get_exposure_durations", []int{500, 1000, 2000, 4000})
+	fake.result("get_exposure", 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go e.Run(ctx) // nolint: errcheck
+
+	waitUntil(t, func() bool { return e.Exposure() == time.Second })
+
+	steps := func(n int, snr float64) {
+		for i := 0; i < n; i++ {
+			fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}, SNR: snr, StarMass: 1000})
+		}
+	}
+
+	steps(5, 8)
+
+	change := <-changes
+	assert.Equal(t, time.Second, change.From)
+	assert.Equal(t, 2*time.Second, change.To)
+	assert.Equal(t, 8.0, change.SNR)
+
+	// The first step is ignored and the exposure is already the longest
+	// allowed.
+	steps(6, 10)
+
+	// Settling is ignored, even though the SNR is out of the band.
+	fake.emit(&phd2.SettleBeginEvent{Event: phd2.Event{Event: "SettleBegin"}})
+	steps(5, 100)
+	fake.emit(&phd2.SettleDoneEvent{Event: phd2.Event{Event: "SettleDone"}})
+
+	steps(5, 100)
+
+	change = <-changes
+	assert.Equal(t, 2*time.Second, change.From)
+	assert.Equal(t, time.Second, change.To)
+	assert.Equal(t, 100.0, change.SNR)
+
+	exposures := fake.callsTo("set_exposure")
+	require.Len(t, exposures, 2)
+	assert.Equal(t, "2000", string(exposures[0].Params[0]))
+	assert.Equal(t, "1000", string(exposures[1].Params[0]))
+}
@@ -0,0 +1,178 @@
+package phd2_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+// fakeHandler answers a JSON-RPC method call made to fakePHD2.
+type fakeHandler func(params []json.RawMessage) (interface{}, error)
+
+type fakeCall struct {
+	Method string
+	Params []json.RawMessage
+}
+
+// fakePHD2 is an in-memory stand in for the PHD2 event server. Methods without
+// a handler succeed with a result of 0.
+type fakePHD2 struct {
+	conn net.Conn
+
+	writeMutex sync.Mutex
+
+	mutex    sync.Mutex
+	handlers map[string]fakeHandler
+	calls    []fakeCall
+}
+
+// newFakePHD2 returns an RPCClient connected to a new fakePHD2.
+func newFakePHD2(t *testing.T) (*phd2.RPCClient, *fakePHD2) {
+	client, server := net.Pipe()
+
+	f := &fakePHD2{
+		conn:     server,
+		handlers: make(map[string]fakeHandler),
+	}
+
+	go f.serve()
+
+	c := phd2.NewRPCClient(&pipeDialer{conn: client})
+	require.NoError(t, c.Connect("127.0.0.1", 4400))
+
+	return c, f
+}
+
+func (f *fakePHD2) handle(method string, h fakeHandler) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.handlers[method] = h
+}
+
+func (f *fakePHD2) result(method string, result interface{}) {
+	f.handle(method, func([]json.RawMessage) (interface{}, error) {
+		return result, nil
+	})
+}
+
+func (f *fakePHD2) methods() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var methods []string
+	for _, call := range f.calls {
+		methods = append(methods, call.Method)
+	}
+
+	return methods
+}
+
+func (f *fakePHD2) callsTo(method string) []fakeCall {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var calls []fakeCall
+	for _, call := range f.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+// emit sends an event to the client. The Event field of evt must be filled in.
+func (f *fakePHD2) emit(evt interface{}) {
+	bytes, err := json.Marshal(evt)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	f.write(bytes)
+}
+
+func (f *fakePHD2) close() {
+	_ = f.conn.Close()
+}
+
+func (f *fakePHD2) write(line []byte) {
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+
+	_, _ = f.conn.Write(append(line, '\r', '\n'))
+}
+
+func (f *fakePHD2) serve() {
+	reader := bufio.NewReader(f.conn)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var req struct {
+			Method string            `json:"method"`
+			ID     int               `json:"id"`
+			Params []json.RawMessage `json:"params"`
+		}
+
+		err = json.Unmarshal(line, &req)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		f.mutex.Lock()
+		f.calls = append(f.calls, fakeCall{Method: req.Method, Params: req.Params})
+		h := f.handlers[req.Method]
+		f.mutex.Unlock()
+
+		resp := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+			"result":  0,
+		}
+
+		if h != nil {
+			result, err := h(req.Params)
+			if err != nil {
+				delete(resp, "result")
+				resp["error"] = map[string]interface{}{
+					"code":    1,
+					"message": err.Error(),
+				}
+			} else {
+				resp["result"] = result
+			}
+		}
+
+		bytes, err := json.Marshal(resp)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		f.write(bytes)
+	}
+}
+
+// waitUntil polls cond until it is true, failing the test if it is not within
+// a second. testify's Eventually can panic when cond is slow.
+func waitUntil(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "condition never satisfied")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,302 @@
+package phd2
+
+import (
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GuideAlgorithm is a guide algorithm, named as PHD2 reports it.
+type GuideAlgorithm string
+
+const (
+	// GuideAlgorithmHysteresis is the Hysteresis algorithm.
+	GuideAlgorithmHysteresis = GuideAlgorithm("Hysteresis")
+	// GuideAlgorithmResistSwitch is the Resist Switch algorithm.
+	GuideAlgorithmResistSwitch = GuideAlgorithm("ResistSwitch")
+	// GuideAlgorithmLowPass2 is the Lowpass2 algorithm.
+	GuideAlgorithmLowPass2 = GuideAlgorithm("Lowpass2")
+	// GuideAlgorithmPPEC is the Predictive PEC algorithm.
+	GuideAlgorithmPPEC = GuideAlgorithm("Predictive PEC")
+)
+
+// AlgorithmParam is the name of a guide algorithm parameter and its valid
+// range.
+type AlgorithmParam struct {
+	Name string
+	Min  float64
+	Max  float64
+}
+
+// GuideAlgorithmParams is implemented by the parameter structs of each guide
+// algorithm: HysteresisParams, ResistSwitchParams, LowPass2Params and
+// PPECParams.
+type GuideAlgorithmParams interface {
+	// Algorithm returns the algorithm the parameters are for.
+	Algorithm() GuideAlgorithm
+	// Params returns the names and valid ranges of the parameters.
+	Params() []AlgorithmParam
+
+	fields() []algorithmField
+}
+
+// algorithmField links a parameter to a field of a parameter struct.
+type algorithmField struct {
+	AlgorithmParam
+	get func() float64
+	set func(float64)
+}
+
+// floatField links a parameter to a float64 field.
+func floatField(param AlgorithmParam, field *float64) algorithmField {
+	return algorithmField{
+		AlgorithmParam: param,
+		get:            func() float64 { return *field },
+		set:            func(v float64) { *field = v },
+	}
+}
+
+// boolField links a parameter PHD2 reports as 0 or 1 to a bool field.
+func boolField(name string, field *bool) algorithmField {
+	return algorithmField{
+		AlgorithmParam: AlgorithmParam{Name: name, Min: 0, Max: 1},
+		get: func() float64 {
+			if *field {
+				return 1
+			}
+			return 0
+		},
+		set: func(v float64) { *field = v != 0 },
+	}
+}
+
+var (
+	minMoveParam    = AlgorithmParam{Name: "minMove", Min: 0, Max: math.Inf(1)}
+	aggressionParam = AlgorithmParam{Name: "aggression", Min: 0, Max: 1}
+)
+
+// HysteresisParams are the parameters of the Hysteresis algorithm.
+type HysteresisParams struct {
+	// MinMove is the minimum move in pixels.
+	MinMove float64
+	// Hysteresis is the fraction of the previous correction carried into the
+	// next.
+	Hysteresis float64
+	// Aggression is the fraction of the error that is corrected.
+	Aggression float64
+}
+
+// Algorithm returns GuideAlgorithmHysteresis.
+func (p *HysteresisParams) Algorithm() GuideAlgorithm {
+	return GuideAlgorithmHysteresis
+}
+
+// Params returns the names and valid ranges of the parameters.
+func (p *HysteresisParams) Params() []AlgorithmParam {
+	return algorithmParams(p)
+}
+
+func (p *HysteresisParams) fields() []algorithmField {
+	return []algorithmField{
+		floatField(minMoveParam, &p.MinMove),
+		floatField(AlgorithmParam{Name: "hysteresis", Min: 0, Max: 0.99}, &p.Hysteresis),
+		floatField(aggressionParam, &p.Aggression),
+	}
+}
+
+// ResistSwitchParams are the parameters of the Resist Switch algorithm.
+type ResistSwitchParams struct {
+	// MinMove is the minimum move in pixels.
+	MinMove float64
+	// Aggression is the fraction of the error that is corrected.
+	Aggression float64
+	// FastSwitch allows switching direction quickly for large errors.
+	FastSwitch bool
+}
+
+// Algorithm returns GuideAlgorithmResistSwitch.
+func (p *ResistSwitchParams) Algorithm() GuideAlgorithm {
+	return GuideAlgorithmResistSwitch
+}
+
+// Params returns the names and valid ranges of the parameters.
+func (p *ResistSwitchParams) Params() []AlgorithmParam {
+	return algorithmParams(p)
+}
+
+func (p *ResistSwitchParams) fields() []algorithmField {
+	return []algorithmField{
+		floatField(minMoveParam, &p.MinMove),
+		floatField(aggressionParam, &p.Aggression),
+		boolField("fastSwitch", &p.FastSwitch),
+	}
+}
+
+// LowPass2Params are the parameters of the Lowpass2 algorithm.
+type LowPass2Params struct {
+	// MinMove is the minimum move in pixels.
+	MinMove float64
+	// Aggressiveness is the percentage of the error that is corrected.
+	Aggressiveness float64
+}
+
+// Algorithm returns GuideAlgorithmLowPass2.
+func (p *LowPass2Params) Algorithm() GuideAlgorithm {
+	return GuideAlgorithmLowPass2
+}
+
+// Params returns the names and valid ranges of the parameters.
+func (p *LowPass2Params) Params() []AlgorithmParam {
+	return algorithmParams(p)
+}
+
+func (p *LowPass2Params) fields() []algorithmField {
+	return []algorithmField{
+		floatField(minMoveParam, &p.MinMove),
+		floatField(AlgorithmParam{Name: "aggressiveness", Min: 0, Max: 100}, &p.Aggressiveness),
+	}
+}
+
+// PPECParams are the parameters of the Predictive PEC algorithm.
+type PPECParams struct {
+	// MinMove is the minimum move in pixels.
+	MinMove float64
+	// ControlGain is the fraction of the measured error that is corrected.
+	ControlGain float64
+	// PredictionGain is the fraction of the predicted periodic error that is
+	// corrected.
+	PredictionGain float64
+}
+
+// Algorithm returns GuideAlgorithmPPEC.
+func (p *PPECParams) Algorithm() GuideAlgorithm {
+	return GuideAlgorithmPPEC
+}
+
+// Params returns the names and valid ranges of the parameters.
+func (p *PPECParams) Params() []AlgorithmParam {
+	return algorithmParams(p)
+}
+
+func (p *PPECParams) fields() []algorithmField {
+	return []algorithmField{
+		floatField(minMoveParam, &p.MinMove),
+		floatField(AlgorithmParam{Name: "controlGain", Min: 0, Max: 1}, &p.ControlGain),
+		floatField(AlgorithmParam{Name: "predictionGain", Min: 0, Max: 1}, &p.PredictionGain),
+	}
+}
+
+func algorithmParams(p GuideAlgorithmParams) []AlgorithmParam {
+	var params []AlgorithmParam
+	for _, f := range p.fields() {
+		params = append(params, f.AlgorithmParam)
+	}
+
+	return params
+}
+
+// ValidateAlgorithmParams returns an error if a parameter is out of range.
+func ValidateAlgorithmParams(p GuideAlgorithmParams) error {
+	for _, f := range p.fields() {
+		v := f.get()
+		if math.IsNaN(v) || v < f.Min || v > f.Max {
+			return errors.Errorf("%s %s out of range [%g, %g]: %g", p.Algorithm(), f.Name, f.Min, f.Max, v)
+		}
+	}
+
+	return nil
+}
+
+// LoadAlgorithmParams loads the parameters of the algorithm on an axis into p.
+// The algorithm is not checked, see GetGuideAlgorithm.
+func LoadAlgorithmParams(c *RPCClient, axis Axis, p GuideAlgorithmParams) error {
+	for _, f := range p.fields() {
+		v, err := c.GetAlgorithmParam(axis, f.Name)
+		if err != nil {
+			return errors.Wrapf(err, "error getting %s %s", axis, f.Name)
+		}
+
+		f.set(v)
+	}
+
+	return nil
+}
+
+// SaveAlgorithmParams validates p and sets the parameters of the algorithm on
+// an axis. The algorithm is not checked, see GetGuideAlgorithm.
+func SaveAlgorithmParams(c *RPCClient, axis Axis, p GuideAlgorithmParams) error {
+	err := ValidateAlgorithmParams(p)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range p.fields() {
+		err = c.SetAlgorithmParam(axis, f.Name, f.get())
+		if err != nil {
+			return errors.Wrapf(err, "error setting %s %s", axis, f.Name)
+		}
+	}
+
+	return nil
+}
+
+// GetGuideAlgorithm returns the algorithm in use on an axis. Names PHD2 reports
+// are matched ignoring case and spaces, and algorithms without a parameter
+// struct are returned as reported.
+func GetGuideAlgorithm(c *RPCClient, axis Axis) (GuideAlgorithm, error) {
+	name, err := c.GetAlgorithmName(axis)
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting %s algorithm name", axis)
+	}
+
+	for _, algorithm := range []GuideAlgorithm{
+		GuideAlgorithmHysteresis,
+		GuideAlgorithmResistSwitch,
+		GuideAlgorithmLowPass2,
+		GuideAlgorithmPPEC,
+	} {
+		if normalizeAlgorithmName(name) == normalizeAlgorithmName(string(algorithm)) {
+			return algorithm, nil
+		}
+	}
+
+	return GuideAlgorithm(name), nil
+}
+
+func normalizeAlgorithmName(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "", -1))
+}
+
+// NewAlgorithmParams returns empty parameters for an algorithm, or nil if it
+// has no parameter struct.
+func NewAlgorithmParams(algorithm GuideAlgorithm) GuideAlgorithmParams {
+	switch algorithm {
+	case GuideAlgorithmHysteresis:
+		return &HysteresisParams{}
+	case GuideAlgorithmResistSwitch:
+		return &ResistSwitchParams{}
+	case GuideAlgorithmLowPass2:
+		return &LowPass2Params{}
+	case GuideAlgorithmPPEC:
+		return &PPECParams{}
+	}
+
+	return nil
+}
+
+// LoadActiveAlgorithmParams detects the algorithm in use on an axis and loads
+// its parameters.
+func LoadActiveAlgorithmParams(c *RPCClient, axis Axis) (GuideAlgorithmParams, error) {
+	algorithm, err := GetGuideAlgorithm(c, axis)
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewAlgorithmParams(algorithm)
+	if p == nil {
+		return nil, errors.Errorf("unsupported %s guide algorithm %q", axis, algorithm)
+	}
+
+	return p, LoadAlgorithmParams(c, axis, p)
+}
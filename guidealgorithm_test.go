@@ -0,0 +1,99 @@
+package phd2_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestAlgorithmParams(t *testing.T) {
+	type testCase struct {
+		name      string
+		algorithm string
+		phd2      map[string]float64
+		params    phd2.GuideAlgorithmParams
+		expected  phd2.GuideAlgorithmParams
+		invalid   phd2.GuideAlgorithmParams
+	}
+
+	testCases := []testCase{
+		{
+			name:      "hysteresis",
+			algorithm: "Hysteresis",
+			phd2:      map[string]float64{"minMove": 0.2, "hysteresis": 0.1, "aggression": 0.7},
+			expected:  &phd2.HysteresisParams{MinMove: 0.2, Hysteresis: 0.1, Aggression: 0.7},
+			invalid:   &phd2.HysteresisParams{MinMove: 0.2, Hysteresis: 0.1, Aggression: 70},
+		},
+		{
+			name:      "resist switch",
+			algorithm: "ResistSwitch",
+			phd2:      map[string]float64{"minMove": 0.2, "aggression": 1, "fastSwitch": 1},
+			expected:  &phd2.ResistSwitchParams{MinMove: 0.2, Aggression: 1, FastSwitch: true},
+			invalid:   &phd2.ResistSwitchParams{MinMove: -1, Aggression: 1},
+		},
+		{
+			name:      "lowpass2",
+			algorithm: "Lowpass2",
+			phd2:      map[string]float64{"minMove": 0.15, "aggressiveness": 80},
+			expected:  &phd2.LowPass2Params{MinMove: 0.15, Aggressiveness: 80},
+			invalid:   &phd2.LowPass2Params{MinMove: 0.15, Aggressiveness: 120},
+		},
+		{
+			name:      "predictive pec",
+			algorithm: "Predictive PEC",
+			phd2:      map[string]float64{"minMove": 0.2, "controlGain": 0.6, "predictionGain": 0.5},
+			expected:  &phd2.PPECParams{MinMove: 0.2, ControlGain: 0.6, PredictionGain: 0.5},
+			invalid:   &phd2.PPECParams{MinMove: 0.2, ControlGain: 60, PredictionGain: 0.5},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, fake := newFakePHD2(t)
+			defer fake.close()
+
+			algorithms := &fakeAlgorithmParams{
+				names:  map[string]string{"ra": tc.algorithm},
+				params: map[string]map[string]float64{"ra": tc.phd2},
+			}
+			algorithms.install(fake)
+
+			params, err := phd2.LoadActiveAlgorithmParams(c, phd2.AxisRA)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, params)
+			assert.Equal(t, tc.expected.Algorithm(), params.Algorithm())
+			assert.Len(t, params.Params(), len(tc.phd2))
+
+			require.NoError(t, phd2.SaveAlgorithmParams(c, phd2.AxisRA, params))
+			assert.Equal(t, tc.phd2, algorithms.params["ra"])
+			assert.Len(t, fake.callsTo("set_algo_param"), len(tc.phd2))
+
+			assert.Error(t, phd2.SaveAlgorithmParams(c, phd2.AxisRA, tc.invalid))
+			assert.Len(t, fake.callsTo("set_algo_param"), len(tc.phd2), "invalid params are not set")
+		})
+	}
+}
+
+func TestGetGuideAlgorithm(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	algorithms := &fakeAlgorithmParams{
+		names: map[string]string{"ra": "lowpass2", "dec": "Identity"},
+	}
+	algorithms.install(fake)
+
+	algorithm, err := phd2.GetGuideAlgorithm(c, phd2.AxisRA)
+	require.NoError(t, err)
+	assert.Equal(t, phd2.GuideAlgorithmLowPass2, algorithm)
+
+	algorithm, err = phd2.GetGuideAlgorithm(c, phd2.AxisDec)
+	require.NoError(t, err)
+	assert.Equal(t, phd2.GuideAlgorithm("Identity"), algorithm)
+
+	_, err = phd2.LoadActiveAlgorithmParams(c, phd2.AxisDec)
+	assert.Error(t, err)
+}
@@ -0,0 +1,403 @@
+package phd2
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SessionState is a state of a GuideSession.
+type SessionState string
+
+const (
+	// SessionStateIdle means the session has not been started or was stopped.
+	SessionStateIdle = SessionState("Idle")
+	// SessionStateStopping means capture is being stopped before starting over.
+	SessionStateStopping = SessionState("Stopping")
+	// SessionStateLooping means exposures are looping and the session is
+	// waiting for enough frames to find a star in.
+	SessionStateLooping = SessionState("Looping")
+	// SessionStateFindingStar means a guide star is being selected.
+	SessionStateFindingStar = SessionState("FindingStar")
+	// SessionStateStartingGuiding means guiding has been requested and the
+	// session is waiting for calibration or guiding to begin.
+	SessionStateStartingGuiding = SessionState("StartingGuiding")
+	// SessionStateCalibrating means PHD2 is calibrating.
+	SessionStateCalibrating = SessionState("Calibrating")
+	// SessionStateSettling means guiding has started and the session is waiting
+	// for it to settle.
+	SessionStateSettling = SessionState("Settling")
+	// SessionStateGuiding means guiding has settled.
+	SessionStateGuiding = SessionState("Guiding")
+	// SessionStateFailed means the session gave up after running out of
+	// retries.
+	SessionStateFailed = SessionState("Failed")
+)
+
+// SessionTransition describes a change of a GuideSession's state.
+type SessionTransition struct {
+	From SessionState
+	To   SessionState
+	Time time.Time
+	// Err is the error that caused the transition, if any.
+	Err error
+}
+
+// GuideSessionConfig configures a GuideSession. Zero timeouts mean a phase has
+// no time limit of its own.
+type GuideSessionConfig struct {
+	// Settle is passed to Guide.
+	Settle Settle
+	// Recalibrate forces calibration the first time guiding is started.
+	Recalibrate bool
+	// LoopFrames is the number of frames to wait for before finding a star.
+	// Defaults to 3.
+	LoopFrames int
+
+	// The time limits of each phase. FindStarTimeout includes waiting for new
+	// frames between retries.
+	StopTimeout        time.Duration
+	LoopTimeout        time.Duration
+	FindStarTimeout    time.Duration
+	StartTimeout       time.Duration
+	CalibrationTimeout time.Duration
+	SettleTimeout      time.Duration
+
+	// FindStarRetries is how many more frames to try finding a star in before
+	// giving up on an attempt.
+	FindStarRetries int
+	// Retries is how many times the whole sequence is started over, from
+	// stopping capture, after an attempt fails.
+	Retries int
+	// RetryDelay is how long to wait before starting over.
+	RetryDelay time.Duration
+
+	// OnTransition, if set, is called on every change of state. It is called
+	// from the goroutine running Start.
+	OnTransition func(SessionTransition)
+}
+
+// GuideSession drives PHD2 from whatever it is doing to settled guiding as an
+// explicit state machine: stop, loop, wait for frames, find a star, calibrate
+// if needed, guide and wait for settling.
+//
+// GuideSession must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type GuideSession struct {
+	c      *RPCClient
+	config GuideSessionConfig
+	queue  *eventQueue
+
+	mutex  sync.Mutex
+	state  SessionState
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewGuideSession creates a new GuideSession.
+func NewGuideSession(c *RPCClient, config GuideSessionConfig) *GuideSession {
+	if config.LoopFrames <= 0 {
+		config.LoopFrames = 3
+	}
+
+	return &GuideSession{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+		state:  SessionStateIdle,
+	}
+}
+
+// HandleEvent queues events for the running session.
+func (s *GuideSession) HandleEvent(evt interface{}) {
+	s.queue.HandleEvent(evt)
+}
+
+// State returns the current state of the session.
+func (s *GuideSession) State() SessionState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state
+}
+
+// Start runs the session until guiding has settled, returning nil, or until
+// it fails, is stopped or the context is done, returning an error. The state is
+// Guiding, Failed or, if the context is done, Idle when Start returns.
+func (s *GuideSession) Start(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.cancel != nil {
+		s.mutex.Unlock()
+		return errors.New("already started")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.cancel = cancel
+	s.done = done
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		s.cancel = nil
+		s.done = nil
+		s.mutex.Unlock()
+
+		cancel()
+		close(done)
+	}()
+
+	recalibrate := s.config.Recalibrate
+
+	var err error
+
+	for attempt := 0; attempt <= s.config.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(s.config.RetryDelay):
+			case <-ctx.Done():
+				s.transition(SessionStateIdle, ctx.Err())
+				return ctx.Err()
+			}
+		}
+
+		err = s.attempt(ctx, recalibrate)
+		if err == nil {
+			s.transition(SessionStateGuiding, nil)
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			s.transition(SessionStateIdle, ctx.Err())
+			return ctx.Err()
+		}
+
+		// Only force calibration once; a later attempt can reuse a
+		// calibration that succeeded before settling failed.
+		recalibrate = false
+	}
+
+	s.transition(SessionStateFailed, err)
+
+	return err
+}
+
+// Stop cancels a running Start, waits for it to return, and stops capture.
+func (s *GuideSession) Stop() error {
+	s.mutex.Lock()
+	cancel := s.cancel
+	done := s.done
+	s.mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+
+	err := s.c.StopCapture()
+
+	s.transition(SessionStateIdle, nil)
+
+	return err
+}
+
+// transition changes the state, ignoring changes to the current state.
+func (s *GuideSession) transition(to SessionState, err error) {
+	s.mutex.Lock()
+	from := s.state
+	s.state = to
+	s.mutex.Unlock()
+
+	if from == to {
+		return
+	}
+
+	if s.config.OnTransition != nil {
+		s.config.OnTransition(SessionTransition{
+			From: from,
+			To:   to,
+			Time: time.Now(),
+			Err:  err,
+		})
+	}
+}
+
+// phase moves to the state and runs fn with the phase's time limit.
+func (s *GuideSession) phase(ctx context.Context, state SessionState, timeout time.Duration, fn func(ctx context.Context) error) error {
+	s.transition(state, nil)
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := fn(ctx)
+	if err == context.DeadlineExceeded {
+		return errors.Wrapf(ErrTimeout, "%s", state)
+	}
+
+	return errors.Wrapf(err, "error in %s", state)
+}
+
+func (s *GuideSession) attempt(ctx context.Context, recalibrate bool) error {
+	err := s.phase(ctx, SessionStateStopping, s.config.StopTimeout, s.stopCapture)
+	if err != nil {
+		return err
+	}
+
+	err = s.phase(ctx, SessionStateLooping, s.config.LoopTimeout, s.loop)
+	if err != nil {
+		return err
+	}
+
+	err = s.phase(ctx, SessionStateFindingStar, s.config.FindStarTimeout, s.findStar)
+	if err != nil {
+		return err
+	}
+
+	return s.guide(ctx, recalibrate)
+}
+
+func (s *GuideSession) stopCapture(ctx context.Context) error {
+	err := s.c.StopCapture()
+	if err != nil {
+		return err
+	}
+
+	return waitForAppState(ctx, s.c, AppStateStopped)
+}
+
+func (s *GuideSession) loop(ctx context.Context) error {
+	s.queue.clear()
+
+	err := s.c.Loop()
+	if err != nil {
+		return err
+	}
+
+	return s.queue.waitForFrames(ctx, s.config.LoopFrames)
+}
+
+func (s *GuideSession) findStar(ctx context.Context) error {
+	var err error
+
+	for i := 0; i <= s.config.FindStarRetries; i++ {
+		if i > 0 {
+			// Give PHD2 a new frame to look in.
+			err = s.queue.waitForFrames(ctx, 1)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = s.c.FindStar()
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// guide requests guiding and follows PHD2's events through calibration,
+// starting guiding and settling, applying the time limit of each.
+func (s *GuideSession) guide(ctx context.Context, recalibrate bool) error { // nolint: gocyclo
+	s.queue.clear()
+
+	s.transition(SessionStateStartingGuiding, nil)
+
+	err := s.c.Guide(s.config.Settle, recalibrate)
+	if err != nil {
+		return errors.Wrapf(err, "error in %s", SessionStateStartingGuiding)
+	}
+
+	state := SessionStateStartingGuiding
+	timeout := s.config.StartTimeout
+
+	for {
+		phaseCtx := ctx
+		cancel := func() {}
+
+		if timeout > 0 {
+			phaseCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		var next SessionState
+
+		err = s.queue.waitFor(phaseCtx, func(evt interface{}) (bool, error) {
+			switch e := evt.(type) {
+			case *StartCalibrationEvent:
+				if state == SessionStateStartingGuiding {
+					next = SessionStateCalibrating
+					return true, nil
+				}
+			case *CalibrationFailedEvent:
+				return true, errors.Errorf("calibration failed: %s", e.Reason)
+			case *StartGuidingEvent:
+				if state != SessionStateSettling {
+					next = SessionStateSettling
+					return true, nil
+				}
+			case *SettleDoneEvent:
+				if e.Status != 0 {
+					return true, errors.Wrap(ErrSettleFailed, e.Error)
+				}
+				next = SessionStateGuiding
+				return true, nil
+			}
+
+			return false, nil
+		})
+
+		cancel()
+
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			return errors.Wrapf(ErrTimeout, "%s", state)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error in %s", state)
+		}
+
+		if next == SessionStateGuiding {
+			return nil
+		}
+
+		state = next
+		s.transition(state, nil)
+
+		switch state {
+		case SessionStateCalibrating:
+			timeout = s.config.CalibrationTimeout
+		case SessionStateSettling:
+			timeout = s.config.SettleTimeout
+		}
+	}
+}
+
+// appStatePollInterval is how often waitForAppState polls.
+const appStatePollInterval = 250 * time.Millisecond
+
+// waitForAppState polls until PHD2 is in one of the given states or the
+// context is done.
+func waitForAppState(ctx context.Context, c *RPCClient, states ...AppState) error {
+	for {
+		current, err := c.GetAppState()
+		if err != nil {
+			return err
+		}
+
+		for _, state := range states {
+			if current == state {
+				return nil
+			}
+		}
+
+		select {
+		case <-time.After(appStatePollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestGuideSession(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	var mutex sync.Mutex
+	var states []phd2.SessionState
+
+	s := phd2.NewGuideSession(c, phd2.GuideSessionConfig{
+		Settle:          phd2.Settle{Pixels: 1.5, TimeSeconds: 10, TimeoutSeconds: 60},
+		LoopFrames:      2,
+		FindStarRetries: 1,
+		SettleTimeout:   time.Second,
+		OnTransition: func(tr phd2.SessionTransition) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			states = append(states, tr.To)
+		},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, s)
+
+	frame := func(n int) {
+		fake.emit(&phd2.LoopingExposuresEvent{Event: phd2.Event{Event: "LoopingExposures"}, Frame: n})
+	}
+
+	fake.result("get_app_state", "Stopped")
+	fake.handle("loop", func([]json.RawMessage) (interface{}, error) {
+		frame(1)
+		frame(2)
+		return 0, nil
+	})
+
+	findStarCalls := 0
+	fake.handle("find_star", func([]json.RawMessage) (interface{}, error) {
+		findStarCalls++
+		if findStarCalls == 1 {
+			go frame(3)
+			return nil, errors.New("no star found")
+		}
+		return []float64{100, 200}, nil
+	})
+
+	fake.handle("guide", func([]json.RawMessage) (interface{}, error) {
+		go func() {
+			fake.emit(&phd2.StartCalibrationEvent{Event: phd2.Event{Event: "StartCalibration"}})
+			fake.emit(&phd2.CalibrationCompleteEvent{Event: phd2.Event{Event: "CalibrationComplete"}})
+			fake.emit(&phd2.StartGuidingEvent{Event: phd2.Event{Event: "StartGuiding"}})
+			fake.emit(&phd2.SettleDoneEvent{Event: phd2.Event{Event: "SettleDone"}})
+		}()
+		return 0, nil
+	})
+
+	require.NoError(t, s.Start(context.Background()))
+	assert.Equal(t, phd2.SessionStateGuiding, s.State())
+	assert.Equal(t, 2, findStarCalls)
+
+	mutex.Lock()
+	assert.Equal(t, []phd2.SessionState{
+		phd2.SessionStateStopping,
+		phd2.SessionStateLooping,
+		phd2.SessionStateFindingStar,
+		phd2.SessionStateStartingGuiding,
+		phd2.SessionStateCalibrating,
+		phd2.SessionStateSettling,
+		phd2.SessionStateGuiding,
+	}, states)
+	mutex.Unlock()
+
+	require.NoError(t, s.Stop())
+	assert.Equal(t, phd2.SessionStateIdle, s.State())
+}
+
+func TestGuideSessionSettleTimeout(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	s := phd2.NewGuideSession(c, phd2.GuideSessionConfig{
+		LoopFrames:    1,
+		SettleTimeout: 10 * time.Millisecond,
+		Retries:       1,
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, s)
+
+	fake.result("get_app_state", "Stopped")
+	fake.handle("loop", func([]json.RawMessage) (interface{}, error) {
+		go fake.emit(&phd2.LoopingExposuresEvent{Event: phd2.Event{Event: "LoopingExposures"}, Frame: 1})
+		return 0, nil
+	})
+	fake.result("find_star", []float64{100, 200})
+	fake.handle("guide", func([]json.RawMessage) (interface{}, error) {
+		go fake.emit(&phd2.StartGuidingEvent{Event: phd2.Event{Event: "StartGuiding"}})
+		return 0, nil
+	})
+
+	err = s.Start(context.Background())
+	assert.EqualError(t, err, "Settling: timed out")
+	assert.Equal(t, phd2.SessionStateFailed, s.State())
+	assert.Len(t, fake.callsTo("guide"), 2)
+}
+
+func TestGuideSessionCancel(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	s := phd2.NewGuideSession(c, phd2.GuideSessionConfig{})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fake.result("get_app_state", "Stopped")
+	fake.handle("loop", func([]json.RawMessage) (interface{}, error) {
+		// No frames arrive, so the session waits until it is cancelled.
+		cancel()
+		return 0, nil
+	})
+
+	err = s.Start(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, phd2.SessionStateIdle, s.State())
+}
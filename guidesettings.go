@@ -0,0 +1,297 @@
+package phd2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// GuideSettingsVersion is the version of the GuideSettings document written by
+// this package.
+const GuideSettingsVersion = 1
+
+// algorithmNameParam is the parameter PHD2 reports the algorithm name under.
+// It is not a number, so it is not part of GuideSettings.
+const algorithmNameParam = "algorithmName"
+
+// GuideSettings is a snapshot of the settings that are tuned for a rig: the
+// guide algorithm parameters of both axes, the Dec guide mode, the exposure and
+// the lock shift. It is saved as JSON with Write or YAML with WriteYAML, and
+// read with ReadGuideSettings or ReadGuideSettingsYAML.
+type GuideSettings struct {
+	Version int `json:"version" yaml:"version"`
+	// Profile is the name of the profile the snapshot was taken from.
+	Profile string    `json:"profile,omitempty" yaml:"profile,omitempty"`
+	Time    time.Time `json:"time" yaml:"time"`
+
+	// RA and Dec are the guide algorithm parameters by name.
+	RA           map[string]float64 `json:"ra" yaml:"ra"`
+	Dec          map[string]float64 `json:"dec" yaml:"dec"`
+	DecGuideMode DecGuideMode       `json:"decGuideMode,omitempty" yaml:"decGuideMode,omitempty"`
+	// Exposure is the exposure in milliseconds, or 0 to leave it unchanged.
+	Exposure  int              `json:"exposure,omitempty" yaml:"exposure,omitempty"`
+	LockShift *LockShiftParams `json:"lockShift,omitempty" yaml:"lockShift,omitempty"`
+}
+
+// GuideSettingDifference is a setting that differs between two GuideSettings.
+type GuideSettingDifference struct {
+	// Setting is "ra/<param>", "dec/<param>", "decGuideMode", "exposure" or
+	// "lockShift".
+	Setting string
+	// Current is the current value, or nil if there is no such setting.
+	Current interface{}
+	// Wanted is the value being restored.
+	Wanted interface{}
+}
+
+func (d GuideSettingDifference) String() string {
+	return fmt.Sprintf("%s: %v -> %v", d.Setting, d.Current, d.Wanted)
+}
+
+// SnapshotGuideSettings takes a snapshot of the current profile's settings.
+func SnapshotGuideSettings(c *RPCClient) (GuideSettings, error) {
+	settings := GuideSettings{
+		Version: GuideSettingsVersion,
+		Time:    time.Now(),
+	}
+
+	profile, err := c.GetProfile()
+	if err != nil {
+		return GuideSettings{}, errors.Wrap(err, "error getting profile")
+	}
+
+	settings.Profile = profile.Name
+
+	settings.RA, err = getAlgorithmParams(c, AxisRA)
+	if err != nil {
+		return GuideSettings{}, err
+	}
+
+	settings.Dec, err = getAlgorithmParams(c, AxisDec)
+	if err != nil {
+		return GuideSettings{}, err
+	}
+
+	settings.DecGuideMode, err = c.GetDecGuideMode()
+	if err != nil {
+		return GuideSettings{}, errors.Wrap(err, "error getting Dec guide mode")
+	}
+
+	exposure, err := c.GetExposure()
+	if err != nil {
+		return GuideSettings{}, errors.Wrap(err, "error getting exposure")
+	}
+
+	settings.Exposure = int(exposure / time.Millisecond)
+
+	lockShift, err := c.GetLockShiftParams()
+	if err != nil {
+		return GuideSettings{}, errors.Wrap(err, "error getting lock shift params")
+	}
+
+	settings.LockShift = &lockShift
+
+	return settings, nil
+}
+
+func getAlgorithmParams(c *RPCClient, axis Axis) (map[string]float64, error) {
+	names, err := c.GetAlgorithmParamNames(axis)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting %s algorithm param names", axis)
+	}
+
+	params := make(map[string]float64)
+	for _, name := range names {
+		if name == algorithmNameParam {
+			continue
+		}
+
+		params[name], err = c.GetAlgorithmParam(axis, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting %s algorithm param %s", axis, name)
+		}
+	}
+
+	return params, nil
+}
+
+// ReadGuideSettings reads settings written by GuideSettings.Write. An error is
+// returned if they are from a newer version of this package.
+func ReadGuideSettings(r io.Reader) (GuideSettings, error) {
+	var settings GuideSettings
+
+	err := json.NewDecoder(r).Decode(&settings)
+	if err != nil {
+		return GuideSettings{}, errors.Wrap(err, "error decoding guide settings")
+	}
+
+	return settings, settings.checkVersion()
+}
+
+// ReadGuideSettingsYAML reads settings written by GuideSettings.WriteYAML. An
+// error is returned if they are from a newer version of this package.
+func ReadGuideSettingsYAML(r io.Reader) (GuideSettings, error) {
+	var settings GuideSettings
+
+	err := yaml.NewDecoder(r).Decode(&settings)
+	if err != nil {
+		return GuideSettings{}, errors.Wrap(err, "error decoding guide settings")
+	}
+
+	return settings, settings.checkVersion()
+}
+
+func (s GuideSettings) checkVersion() error {
+	if s.Version < 1 || s.Version > GuideSettingsVersion {
+		return errors.Errorf("unsupported guide settings version %d", s.Version)
+	}
+
+	return nil
+}
+
+// Write writes the settings as indented JSON.
+func (s GuideSettings) Write(w io.Writer) error {
+	if s.Version == 0 {
+		s.Version = GuideSettingsVersion
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return errors.Wrap(encoder.Encode(s), "error encoding guide settings")
+}
+
+// WriteYAML writes the settings as YAML.
+func (s GuideSettings) WriteYAML(w io.Writer) error {
+	if s.Version == 0 {
+		s.Version = GuideSettingsVersion
+	}
+
+	encoder := yaml.NewEncoder(w)
+
+	err := encoder.Encode(s)
+	if err != nil {
+		return errors.Wrap(err, "error encoding guide settings")
+	}
+
+	return errors.Wrap(encoder.Close(), "error encoding guide settings")
+}
+
+// DiffGuideSettings returns the settings in wanted that differ from current,
+// sorted by setting. Algorithm parameters current does not have are included
+// with a nil Current, as they cannot be restored.
+func DiffGuideSettings(current, wanted GuideSettings) []GuideSettingDifference {
+	var diffs []GuideSettingDifference
+
+	for _, axis := range []struct {
+		axis    Axis
+		current map[string]float64
+		wanted  map[string]float64
+	}{
+		{AxisRA, current.RA, wanted.RA},
+		{AxisDec, current.Dec, wanted.Dec},
+	} {
+		for name, value := range axis.wanted {
+			setting := string(axis.axis) + "/" + name
+
+			currentValue, ok := axis.current[name]
+			if !ok {
+				diffs = append(diffs, GuideSettingDifference{Setting: setting, Wanted: value})
+			} else if math.Abs(currentValue-value) > 1e-9 {
+				diffs = append(diffs, GuideSettingDifference{Setting: setting, Current: currentValue, Wanted: value})
+			}
+		}
+	}
+
+	if wanted.DecGuideMode != "" && wanted.DecGuideMode != current.DecGuideMode {
+		diffs = append(diffs, GuideSettingDifference{Setting: "decGuideMode", Current: current.DecGuideMode, Wanted: wanted.DecGuideMode})
+	}
+
+	if wanted.Exposure > 0 && wanted.Exposure != current.Exposure {
+		diffs = append(diffs, GuideSettingDifference{Setting: "exposure", Current: current.Exposure, Wanted: wanted.Exposure})
+	}
+
+	if wanted.LockShift != nil && (current.LockShift == nil || !lockShiftEqual(*current.LockShift, *wanted.LockShift)) {
+		diffs = append(diffs, GuideSettingDifference{Setting: "lockShift", Current: current.LockShift, Wanted: wanted.LockShift})
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Setting < diffs[j].Setting
+	})
+
+	return diffs
+}
+
+// RestoreGuideSettings applies settings to the current profile and returns
+// what was different. Algorithm parameters the current algorithms do not have
+// are returned but not set, so settings can be restored after the algorithm
+// has been changed. The Profile in settings is not checked.
+func RestoreGuideSettings(c *RPCClient, settings GuideSettings) ([]GuideSettingDifference, error) {
+	current, err := SnapshotGuideSettings(c)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := DiffGuideSettings(current, settings)
+
+	for _, d := range diffs {
+		switch {
+		case d.Setting == "decGuideMode":
+			err = c.SetDecGuideMode(settings.DecGuideMode)
+			if err != nil {
+				return diffs, errors.Wrap(err, "error setting Dec guide mode")
+			}
+		case d.Setting == "exposure":
+			err = c.SetExposure(time.Duration(settings.Exposure) * time.Millisecond)
+			if err != nil {
+				return diffs, errors.Wrap(err, "error setting exposure")
+			}
+		case d.Setting == "lockShift":
+			err = c.SetLockShiftParams(*settings.LockShift)
+			if err != nil {
+				return diffs, errors.Wrap(err, "error setting lock shift params")
+			}
+
+			err = c.SetLockShiftEnabled(settings.LockShift.Enabled)
+			if err != nil {
+				return diffs, errors.Wrap(err, "error enabling lock shift")
+			}
+		case d.Current != nil:
+			parts := strings.SplitN(d.Setting, "/", 2)
+
+			err = c.SetAlgorithmParam(Axis(parts[0]), parts[1], d.Wanted.(float64))
+			if err != nil {
+				return diffs, errors.Wrapf(err, "error setting %s", d.Setting)
+			}
+		}
+	}
+
+	return diffs, nil
+}
+
+// ApplyGuideSettingsTemplate brings up the rig in config with BringUp and
+// restores settings taken from another rig to its profile, returning what was
+// different. If config has no exposure, the template's is used.
+func ApplyGuideSettingsTemplate(ctx context.Context, c *RPCClient, settings GuideSettings, config RigConfig) ([]GuideSettingDifference, error) {
+	if config.Exposure == 0 {
+		config.Exposure = time.Duration(settings.Exposure) * time.Millisecond
+	}
+
+	err := BringUp(ctx, c, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// BringUp has set the exposure the rig should use.
+	settings.Exposure = 0
+
+	return RestoreGuideSettings(c, settings)
+}
@@ -0,0 +1,213 @@
+package phd2_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+// fakeAlgorithmParams models the guide algorithm parameters of both axes.
+type fakeAlgorithmParams struct {
+	mutex  sync.Mutex
+	names  map[string]string
+	params map[string]map[string]float64
+}
+
+func (p *fakeAlgorithmParams) install(fake *fakePHD2) {
+	fake.handle("get_algo_param_names", func(params []json.RawMessage) (interface{}, error) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		var axis string
+		_ = json.Unmarshal(params[0], &axis)
+
+		names := []string{"algorithmName"}
+		for name := range p.params[axis] {
+			names = append(names, name)
+		}
+
+		return names, nil
+	})
+	fake.handle("get_algo_param", func(params []json.RawMessage) (interface{}, error) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		var axis, name string
+		_ = json.Unmarshal(params[0], &axis)
+		_ = json.Unmarshal(params[1], &name)
+
+		if name == "algorithmName" {
+			return p.names[axis], nil
+		}
+
+		return p.params[axis][name], nil
+	})
+	fake.handle("set_algo_param", func(params []json.RawMessage) (interface{}, error) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		var axis, name string
+		var value float64
+		_ = json.Unmarshal(params[0], &axis)
+		_ = json.Unmarshal(params[1], &name)
+		_ = json.Unmarshal(params[2], &value)
+
+		p.params[axis][name] = value
+		return 0, nil
+	})
+}
+
+func TestGuideSettings(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	algorithms := &fakeAlgorithmParams{
+		params: map[string]map[string]float64{
+			"ra":  {"minMove": 0.2, "hysteresis": 10, "aggression": 70},
+			"dec": {"minMove": 0.3, "aggression": 100},
+		},
+	}
+	algorithms.install(fake)
+
+	fake.result("get_profile", phd2.Profile{ID: 1, Name: "Refractor"})
+	fake.result("get_dec_guide_mode", "Auto")
+	fake.result("get_exposure", 2000)
+	fake.result("get_lock_shift_params", phd2.LockShiftParams{
+		Rate:  []float64{0, 0},
+		Units: phd2.LockShiftUnitsArcsecPerHour,
+		Axes:  phd2.LockShiftAxesRADec,
+	})
+
+	settings, err := phd2.SnapshotGuideSettings(c)
+	require.NoError(t, err)
+	assert.Equal(t, "Refractor", settings.Profile)
+	assert.Equal(t, map[string]float64{"minMove": 0.2, "hysteresis": 10, "aggression": 70}, settings.RA)
+	assert.Equal(t, map[string]float64{"minMove": 0.3, "aggression": 100}, settings.Dec)
+	assert.Equal(t, phd2.DecGuideModeAuto, settings.DecGuideMode)
+	assert.Equal(t, 2000, settings.Exposure)
+
+	var buf bytes.Buffer
+	require.NoError(t, settings.Write(&buf))
+
+	read, err := phd2.ReadGuideSettings(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, settings.RA, read.RA)
+	assert.Equal(t, settings.Dec, read.Dec)
+	assert.Equal(t, settings.LockShift, read.LockShift)
+	assert.True(t, settings.Time.Equal(read.Time))
+
+	// Someone fiddles in the GUI, and a parameter of another algorithm is in
+	// the settings being restored.
+	algorithms.params["ra"]["aggression"] = 50
+	algorithms.params["dec"]["minMove"] = 0.5
+	fake.result("get_dec_guide_mode", "North")
+	read.RA["predictionGain"] = 0.5
+
+	diffs, err := phd2.RestoreGuideSettings(c, read)
+	require.NoError(t, err)
+	assert.Equal(t, []phd2.GuideSettingDifference{
+		{Setting: "dec/minMove", Current: 0.5, Wanted: 0.3},
+		{Setting: "decGuideMode", Current: phd2.DecGuideModeNorth, Wanted: phd2.DecGuideModeAuto},
+		{Setting: "ra/aggression", Current: 50.0, Wanted: 70.0},
+		{Setting: "ra/predictionGain", Wanted: 0.5},
+	}, diffs)
+
+	assert.Equal(t, 70.0, algorithms.params["ra"]["aggression"])
+	assert.Equal(t, 0.3, algorithms.params["dec"]["minMove"])
+	assert.Len(t, fake.callsTo("set_algo_param"), 2)
+	assert.Len(t, fake.callsTo("set_dec_guide_mode"), 1)
+	assert.Empty(t, fake.callsTo("set_exposure"))
+	assert.Empty(t, fake.callsTo("set_lock_shift_params"))
+}
+
+func TestReadGuideSettingsVersion(t *testing.T) {
+	_, err := phd2.ReadGuideSettings(strings.NewReader(`{"version":2,"ra":{}}`))
+	assert.Error(t, err)
+
+	_, err = phd2.ReadGuideSettings(strings.NewReader(`{"ra":{}}`))
+	assert.Error(t, err)
+
+	_, err = phd2.ReadGuideSettingsYAML(strings.NewReader("version: 2\nra: {}\n"))
+	assert.Error(t, err)
+}
+
+func TestGuideSettingsYAML(t *testing.T) {
+	settings := phd2.GuideSettings{
+		Profile:      "Refractor",
+		Time:         time.Date(2020, 3, 1, 22, 30, 0, 0, time.UTC),
+		RA:           map[string]float64{"minMove": 0.2, "aggression": 0.7},
+		Dec:          map[string]float64{"minMove": 0.3},
+		DecGuideMode: phd2.DecGuideModeAuto,
+		Exposure:     2000,
+		LockShift: &phd2.LockShiftParams{
+			Enabled: true,
+			Rate:    []float64{1.5, -2},
+			Units:   phd2.LockShiftUnitsArcsecPerHour,
+			Axes:    phd2.LockShiftAxesRADec,
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, settings.WriteYAML(&buf))
+	assert.Contains(t, buf.String(), "decGuideMode: Auto")
+
+	read, err := phd2.ReadGuideSettingsYAML(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, phd2.GuideSettingsVersion, read.Version)
+	assert.Equal(t, settings.Profile, read.Profile)
+	assert.True(t, settings.Time.Equal(read.Time))
+	assert.Equal(t, settings.RA, read.RA)
+	assert.Equal(t, settings.Dec, read.Dec)
+	assert.Equal(t, settings.DecGuideMode, read.DecGuideMode)
+	assert.Equal(t, settings.Exposure, read.Exposure)
+	assert.Equal(t, settings.LockShift, read.LockShift)
+}
+
+func TestApplyGuideSettingsTemplate(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	rig := &fakeRig{profile: 1, state: phd2.AppStateStopped, exposure: 1000}
+	rig.install(fake)
+
+	algorithms := &fakeAlgorithmParams{
+		params: map[string]map[string]float64{
+			"ra":  {"minMove": 0.2},
+			"dec": {"minMove": 0.3},
+		},
+	}
+	algorithms.install(fake)
+
+	fake.result("get_dec_guide_mode", "Auto")
+	fake.result("get_lock_shift_params", phd2.LockShiftParams{Rate: []float64{0, 0}})
+
+	template := phd2.GuideSettings{
+		Version:  phd2.GuideSettingsVersion,
+		Profile:  "Refractor",
+		RA:       map[string]float64{"minMove": 0.15},
+		Dec:      map[string]float64{"minMove": 0.3},
+		Exposure: 3000,
+	}
+
+	diffs, err := phd2.ApplyGuideSettingsTemplate(context.Background(), c, template, phd2.RigConfig{
+		Profile:    "Newtonian",
+		RetryDelay: time.Millisecond,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []phd2.GuideSettingDifference{
+		{Setting: "ra/minMove", Current: 0.2, Wanted: 0.15},
+	}, diffs)
+
+	assert.Equal(t, 2, rig.profile)
+	assert.Equal(t, 3000, rig.exposure)
+	assert.Equal(t, 0.15, algorithms.params["ra"]["minMove"])
+}
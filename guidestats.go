@@ -0,0 +1,283 @@
+package phd2
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GuideStatsWindow selects the guide steps statistics are computed over. The
+// zero value selects the whole session.
+type GuideStatsWindow struct {
+	// Frames limits the window to the last Frames guide steps.
+	Frames int
+	// Duration limits the window to guide steps within Duration of the latest.
+	Duration time.Duration
+}
+
+// GuideAxisStats are the statistics of one guide axis. Distances are in
+// pixels; the arc-sec fields are only set if the pixel scale is known.
+type GuideAxisStats struct {
+	// RMS is the standard deviation of the raw distance, as PHD2 reports it.
+	RMS       float64
+	RMSArcsec float64
+	// Peak is the largest absolute raw distance.
+	Peak       float64
+	PeakArcsec float64
+	// Mean is the mean raw distance.
+	Mean float64
+	// Drift is the rate of change of the raw distance in pixels/minute, from a
+	// least squares fit.
+	Drift float64
+	// CorrectionPercent is the percentage of frames with a guide pulse.
+	CorrectionPercent float64
+	// LimitedPercent is the percentage of guide pulses that were limited by
+	// the maximum pulse duration.
+	LimitedPercent float64
+}
+
+// GuideStatsSnapshot are the statistics of a window of guide steps.
+type GuideStatsSnapshot struct {
+	Frames int
+	// Duration is the time between the first and last guide steps.
+	Duration time.Duration
+	RA       GuideAxisStats
+	Dec      GuideAxisStats
+	// TotalRMS combines the RA and Dec RMS.
+	TotalRMS       float64
+	TotalRMSArcsec float64
+	// PixelScale is the pixel scale in arc-sec/pixel, or 0 if it is not known.
+	PixelScale float64
+}
+
+// guideSample is the part of a guide step that statistics are computed from.
+type guideSample struct {
+	time       float64
+	ra, dec    float64
+	raPulse    bool
+	decPulse   bool
+	raLimited  bool
+	decLimited bool
+}
+
+// settleTracker follows whether guide steps are being made while settling
+// after a dither, or after guiding starts, from the settling events.
+type settleTracker struct {
+	settling bool
+	// requested is set from SettleBegin, which PHD2 sends for a guide
+	// request before guiding starts, until the settle is done.
+	requested bool
+}
+
+// handleEvent updates the settling state from an event.
+func (t *settleTracker) handleEvent(evt interface{}) {
+	switch evt.(type) {
+	case *SettleBeginEvent:
+		t.settling = true
+		t.requested = true
+	case *GuidingDitheredEvent:
+		t.settling = true
+	case *SettleDoneEvent, *GuidingStoppedEvent:
+		t.settling = false
+		t.requested = false
+	case *StartGuidingEvent:
+		// Guiding started from PHD2 itself has no settle to wait for.
+		t.settling = t.requested
+	}
+}
+
+// guideStatsMaxSamples is how many guide steps GuideStats keeps of each kind,
+// several hours of guiding at typical exposures.
+const guideStatsMaxSamples = 20000
+
+// GuideStats keeps rolling guiding statistics from GuideStep events. The
+// statistics are reset each time guiding starts, and only the latest guide
+// steps are kept. Guide steps made while settling after a dither, or after
+// guiding starts, are kept apart from those made while guiding steadily.
+//
+// GuideStats must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type GuideStats struct {
+	mutex      sync.Mutex
+	pixelScale float64
+	settle     settleTracker
+	guiding    []guideSample
+	settling   []guideSample
+}
+
+// NewGuideStats creates a new GuideStats. The pixel scale, in arc-sec/pixel,
+// may be 0 if only statistics in pixels are needed.
+func NewGuideStats(pixelScale float64) *GuideStats {
+	return &GuideStats{
+		pixelScale: pixelScale,
+	}
+}
+
+// UpdatePixelScale reads the pixel scale from PHD2.
+func (s *GuideStats) UpdatePixelScale(c *RPCClient) error {
+	pixelScale, err := c.GetPixelScale()
+	if err != nil {
+		return errors.Wrap(err, "error getting pixel scale")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pixelScale = pixelScale
+
+	return nil
+}
+
+// HandleEvent records guide steps.
+func (s *GuideStats) HandleEvent(evt interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.settle.handleEvent(evt)
+
+	switch e := evt.(type) {
+	case *StartGuidingEvent:
+		s.guiding = nil
+		s.settling = nil
+	case *GuideStepEvent:
+		sample := guideSample{
+			time:       e.Time,
+			ra:         e.RADistanceRaw,
+			dec:        e.DecDistanceRaw,
+			raPulse:    e.RADuration > 0,
+			decPulse:   e.DecDuration > 0,
+			raLimited:  e.RALimited,
+			decLimited: e.DecLimited,
+		}
+
+		if s.settle.settling {
+			s.settling = appendGuideSample(s.settling, sample)
+		} else {
+			s.guiding = appendGuideSample(s.guiding, sample)
+		}
+	}
+}
+
+// appendGuideSample appends a sample, dropping the oldest beyond
+// guideStatsMaxSamples.
+func appendGuideSample(samples []guideSample, sample guideSample) []guideSample {
+	if len(samples) >= guideStatsMaxSamples {
+		samples = samples[len(samples)-guideStatsMaxSamples+1:]
+	}
+
+	return append(samples, sample)
+}
+
+// Reset discards all guide steps.
+func (s *GuideStats) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.guiding = nil
+	s.settling = nil
+}
+
+// Stats returns the statistics of the guide steps in the window made while
+// guiding steadily.
+func (s *GuideStats) Stats(window GuideStatsWindow) GuideStatsSnapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return guideStatsOf(window.apply(s.guiding), s.pixelScale)
+}
+
+// SettlingStats returns the statistics of the guide steps in the window made
+// while settling.
+func (s *GuideStats) SettlingStats(window GuideStatsWindow) GuideStatsSnapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return guideStatsOf(window.apply(s.settling), s.pixelScale)
+}
+
+func (w GuideStatsWindow) apply(samples []guideSample) []guideSample {
+	if w.Frames > 0 && len(samples) > w.Frames {
+		samples = samples[len(samples)-w.Frames:]
+	}
+
+	if w.Duration > 0 && len(samples) > 0 {
+		start := samples[len(samples)-1].time - w.Duration.Seconds()
+
+		i := 0
+		for i < len(samples) && samples[i].time < start {
+			i++
+		}
+
+		samples = samples[i:]
+	}
+
+	return samples
+}
+
+func guideStatsOf(samples []guideSample, pixelScale float64) GuideStatsSnapshot {
+	stats := GuideStatsSnapshot{
+		Frames:     len(samples),
+		PixelScale: pixelScale,
+	}
+
+	if len(samples) == 0 {
+		return stats
+	}
+
+	times := make([]float64, len(samples))
+	ra := make([]float64, len(samples))
+	dec := make([]float64, len(samples))
+
+	var raPulses, decPulses, raLimited, decLimited int
+
+	for i, sample := range samples {
+		times[i] = sample.time / 60
+		ra[i] = sample.ra
+		dec[i] = sample.dec
+
+		if sample.raPulse {
+			raPulses++
+		}
+		if sample.decPulse {
+			decPulses++
+		}
+		if sample.raLimited {
+			raLimited++
+		}
+		if sample.decLimited {
+			decLimited++
+		}
+	}
+
+	stats.Duration = time.Duration((samples[len(samples)-1].time - samples[0].time) * float64(time.Second))
+	stats.RA = guideAxisStatsOf(times, ra, raPulses, raLimited, pixelScale)
+	stats.Dec = guideAxisStatsOf(times, dec, decPulses, decLimited, pixelScale)
+	stats.TotalRMS = math.Hypot(stats.RA.RMS, stats.Dec.RMS)
+	stats.TotalRMSArcsec = stats.TotalRMS * pixelScale
+
+	return stats
+}
+
+func guideAxisStatsOf(minutes, distances []float64, pulses, limited int, pixelScale float64) GuideAxisStats {
+	var stats GuideAxisStats
+
+	stats.RMS = stdDev(distances)
+	stats.Mean = mean(distances)
+	stats.Drift, _, _ = linearFit(minutes, distances)
+
+	for _, d := range distances {
+		stats.Peak = math.Max(stats.Peak, math.Abs(d))
+	}
+
+	stats.RMSArcsec = stats.RMS * pixelScale
+	stats.PeakArcsec = stats.Peak * pixelScale
+
+	stats.CorrectionPercent = 100 * float64(pulses) / float64(len(distances))
+	if pulses > 0 {
+		stats.LimitedPercent = 100 * float64(limited) / float64(pulses)
+	}
+
+	return stats
+}
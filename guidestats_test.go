@@ -0,0 +1,96 @@
+package phd2_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/goastro/phd2"
+)
+
+func guideStep(t float64, ra, dec float64) *phd2.GuideStepEvent {
+	return &phd2.GuideStepEvent{
+		Event:          phd2.Event{Event: "GuideStep"},
+		Time:           t,
+		RADistanceRaw:  ra,
+		DecDistanceRaw: dec,
+	}
+}
+
+func TestGuideStats(t *testing.T) {
+	s := phd2.NewGuideStats(2)
+
+	s.HandleEvent(guideStep(0, 5, 5))
+	s.HandleEvent(&phd2.StartGuidingEvent{})
+
+	for i := 0; i < 4; i++ {
+		step := guideStep(float64(i)*30, 1, float64(i))
+		if i%2 == 0 {
+			step.RADistanceRaw = -1
+			step.RADuration = 200
+			step.RALimited = i == 0
+		}
+		s.HandleEvent(step)
+	}
+
+	stats := s.Stats(phd2.GuideStatsWindow{})
+	assert.Equal(t, 4, stats.Frames)
+	assert.InDelta(t, 1.5, stats.Dec.Mean, 1e-9)
+	assert.InDelta(t, 2, stats.Dec.Drift, 1e-9, "one pixel every 30s")
+	assert.InDelta(t, 1.118033988749895, stats.Dec.RMS, 1e-9)
+
+	s.HandleEvent(&phd2.GuidingDitheredEvent{DX: 3})
+	s.HandleEvent(guideStep(120, 3, 0))
+	s.HandleEvent(guideStep(150, 0.5, 0))
+	s.HandleEvent(&phd2.SettleDoneEvent{})
+	s.HandleEvent(guideStep(180, 1, 4))
+
+	stats = s.Stats(phd2.GuideStatsWindow{Frames: 5})
+	assert.Equal(t, 5, stats.Frames)
+	assert.Equal(t, 180*time.Second, stats.Duration)
+	assert.InDelta(t, 0.2, stats.RA.Mean, 1e-9)
+	assert.InDelta(t, 40, stats.RA.CorrectionPercent, 1e-9)
+	assert.InDelta(t, 50, stats.RA.LimitedPercent, 1e-9)
+	assert.InDelta(t, 4, stats.Dec.Peak, 1e-9)
+	assert.InDelta(t, 8, stats.Dec.PeakArcsec, 1e-9)
+	assert.InDelta(t, 2*stats.TotalRMS, stats.TotalRMSArcsec, 1e-9)
+
+	stats = s.Stats(phd2.GuideStatsWindow{Duration: time.Minute})
+	assert.Equal(t, 1, stats.Frames, "only the last frame is within a minute")
+
+	stats = s.SettlingStats(phd2.GuideStatsWindow{})
+	assert.Equal(t, 2, stats.Frames)
+	assert.InDelta(t, 3, stats.RA.Peak, 1e-9)
+
+	s.HandleEvent(&phd2.StartGuidingEvent{})
+	assert.Equal(t, 0, s.Stats(phd2.GuideStatsWindow{}).Frames)
+}
+
+func TestGuideStatsSettling(t *testing.T) {
+	s := phd2.NewGuideStats(0)
+
+	// A guide request settles after guiding starts.
+	s.HandleEvent(&phd2.SettleBeginEvent{})
+	s.HandleEvent(&phd2.StartGuidingEvent{})
+	s.HandleEvent(guideStep(0, 1, 1))
+	assert.Equal(t, 1, s.SettlingStats(phd2.GuideStatsWindow{}).Frames)
+
+	// Guiding stops before the dither settles.
+	s.HandleEvent(&phd2.GuidingDitheredEvent{})
+	s.HandleEvent(&phd2.GuidingStoppedEvent{})
+
+	// Guiding started from PHD2 has nothing to settle.
+	s.HandleEvent(&phd2.StartGuidingEvent{})
+	s.HandleEvent(guideStep(0, 1, 1))
+	assert.Equal(t, 1, s.Stats(phd2.GuideStatsWindow{}).Frames)
+	assert.Equal(t, 0, s.SettlingStats(phd2.GuideStatsWindow{}).Frames)
+
+	for i := 0; i < 25000; i++ {
+		s.HandleEvent(guideStep(float64(i), 1, 1))
+	}
+
+	stats := s.Stats(phd2.GuideStatsWindow{})
+	assert.Equal(t, 20000, stats.Frames, "only the latest steps are kept")
+	assert.Equal(t, 19999*time.Second, stats.Duration)
+}
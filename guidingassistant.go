@@ -0,0 +1,293 @@
+package phd2
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GuidingAssistantConfig configures a GuidingAssistant.
+type GuidingAssistantConfig struct {
+	// Duration is how long to measure unguided motion for. PHD2 suggests at
+	// least two minutes.
+	Duration time.Duration
+	// PixelScale is the pixel scale in arc-sec/pixel. If 0, it is read from
+	// PHD2.
+	PixelScale float64
+}
+
+// GuidingAssistantResult is the result of a GuidingAssistant measurement.
+type GuidingAssistantResult struct {
+	Frames   int
+	Duration time.Duration
+	// Exposure is the mean interval between guide steps.
+	Exposure   time.Duration
+	PixelScale float64
+
+	// RAHighFrequency and DecHighFrequency are the RMS star motion about the
+	// drift in pixels, which is mostly seeing.
+	RAHighFrequency        float64
+	RAHighFrequencyArcsec  float64
+	DecHighFrequency       float64
+	DecHighFrequencyArcsec float64
+	// RAPeakToPeak is the range of the RA motion about the drift in pixels,
+	// which includes periodic error.
+	RAPeakToPeak       float64
+	RAPeakToPeakArcsec float64
+	// RADrift and DecDrift are the drift rates in pixels/minute.
+	RADrift        float64
+	RADriftArcsec  float64
+	DecDrift       float64
+	DecDriftArcsec float64
+	// DecDriftDominant is true if the Dec drift in a minute is larger than
+	// the high-frequency Dec motion. Guiding in one Dec direction then avoids
+	// Dec backlash.
+	DecDriftDominant bool
+
+	Recommendations GuidingRecommendations
+}
+
+// GuidingRecommendations are the guide algorithm settings recommended by a
+// GuidingAssistant.
+type GuidingRecommendations struct {
+	// RAMinMove and DecMinMove are minimum moves in pixels.
+	RAMinMove  float64
+	DecMinMove float64
+	// RAAggressiveness is the RA aggressiveness as a percentage.
+	RAAggressiveness float64
+	// DecGuideMode is DecGuideModeAuto, or guiding in one direction when the
+	// Dec drift is dominant.
+	DecGuideMode DecGuideMode
+}
+
+// GuidingAssistant measures seeing and drift with guide output disabled, as
+// PHD2's Guiding Assistant does, and recommends guide algorithm settings.
+//
+// GuidingAssistant must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type GuidingAssistant struct {
+	c      *RPCClient
+	config GuidingAssistantConfig
+	queue  *eventQueue
+}
+
+// NewGuidingAssistant creates a new GuidingAssistant.
+func NewGuidingAssistant(c *RPCClient, config GuidingAssistantConfig) *GuidingAssistant {
+	return &GuidingAssistant{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent queues events for measuring.
+func (a *GuidingAssistant) HandleEvent(evt interface{}) {
+	a.queue.HandleEvent(evt)
+}
+
+// Measure disables guide output, measures the unguided motion of the star for
+// the configured duration while PHD2 is guiding, and then restores guide output
+// to how it was.
+func (a *GuidingAssistant) Measure(ctx context.Context) (result GuidingAssistantResult, err error) {
+	result.PixelScale = a.config.PixelScale
+	if result.PixelScale <= 0 {
+		result.PixelScale, err = a.c.GetPixelScale()
+		if err != nil {
+			return result, errors.Wrap(err, "error getting pixel scale")
+		}
+	}
+
+	enabled, err := a.c.GetGuideOutputEnabled()
+	if err != nil {
+		return result, errors.Wrap(err, "error getting guide output enabled")
+	}
+
+	a.queue.clear()
+
+	err = a.c.SetGuideOutputEnabled(false)
+	if err != nil {
+		return result, errors.Wrap(err, "error disabling guide output")
+	}
+
+	defer func() {
+		restoreErr := a.c.SetGuideOutputEnabled(enabled)
+		if restoreErr != nil && err == nil {
+			err = errors.Wrap(restoreErr, "error restoring guide output")
+		}
+	}()
+
+	steps, err := a.queue.collectGuideSteps(ctx, a.config.Duration)
+	if err != nil {
+		return result, errors.Wrap(err, "error measuring unguided motion")
+	}
+
+	if len(steps) < 3 {
+		return result, errors.Errorf("too few guide steps to measure unguided motion: %d", len(steps))
+	}
+
+	analyzeUnguided(&result, steps)
+
+	return result, nil
+}
+
+func analyzeUnguided(result *GuidingAssistantResult, steps []*GuideStepEvent) {
+	minutes := make([]float64, len(steps))
+	ra := make([]float64, len(steps))
+	dec := make([]float64, len(steps))
+
+	for i, step := range steps {
+		minutes[i] = step.Time / 60
+		ra[i] = step.RADistanceRaw
+		dec[i] = step.DecDistanceRaw
+	}
+
+	span := minutes[len(minutes)-1] - minutes[0]
+
+	result.Frames = len(steps)
+	result.Duration = time.Duration(span * float64(time.Minute))
+	result.Exposure = result.Duration / time.Duration(len(steps)-1)
+
+	raResiduals := detrend(minutes, ra, &result.RADrift)
+	decResiduals := detrend(minutes, dec, &result.DecDrift)
+
+	result.RAHighFrequency = stdDev(raResiduals)
+	result.DecHighFrequency = stdDev(decResiduals)
+
+	minRA, maxRA := raResiduals[0], raResiduals[0]
+	for _, r := range raResiduals {
+		minRA = math.Min(minRA, r)
+		maxRA = math.Max(maxRA, r)
+	}
+
+	result.RAPeakToPeak = maxRA - minRA
+	result.DecDriftDominant = math.Abs(result.DecDrift) > result.DecHighFrequency
+
+	scale := result.PixelScale
+	result.RAHighFrequencyArcsec = result.RAHighFrequency * scale
+	result.DecHighFrequencyArcsec = result.DecHighFrequency * scale
+	result.RAPeakToPeakArcsec = result.RAPeakToPeak * scale
+	result.RADriftArcsec = result.RADrift * scale
+	result.DecDriftArcsec = result.DecDrift * scale
+
+	result.Recommendations = recommendGuiding(result)
+}
+
+// detrend sets the slope of a straight line fitted to the values and returns
+// what is left of them when it is removed.
+func detrend(xs, ys []float64, slope *float64) []float64 {
+	var intercept float64
+	*slope, intercept, _ = linearFit(xs, ys)
+
+	residuals := make([]float64, len(ys))
+	for i := range ys {
+		residuals[i] = ys[i] - (*slope*xs[i] + intercept)
+	}
+
+	return residuals
+}
+
+// recommendGuiding recommends settings in the same way as PHD2's Guiding
+// Assistant: minimum moves large enough that most corrections are not chasing
+// seeing, with a little more margin in Dec where chasing seeing costs
+// backlash.
+func recommendGuiding(result *GuidingAssistantResult) GuidingRecommendations {
+	decMultiplier := 1.2
+	if result.PixelScale < 1.5 {
+		decMultiplier = 1.28
+	}
+
+	r := GuidingRecommendations{
+		RAMinMove:    math.Max(0.1, 0.65*result.RAHighFrequency),
+		DecMinMove:   math.Max(0.1, decMultiplier*result.DecHighFrequency),
+		DecGuideMode: DecGuideModeAuto,
+	}
+
+	// Corrections should be firm when the RA drift between frames stands
+	// out from seeing, and gentle when they would mostly be chasing it.
+	driftPerFrame := math.Abs(result.RADrift) * result.Exposure.Minutes()
+	ratio := 1.0
+	if result.RAHighFrequency > 0 {
+		ratio = math.Min(1, driftPerFrame/result.RAHighFrequency)
+	}
+
+	r.RAAggressiveness = math.Round(60 + 40*ratio)
+
+	if result.DecDriftDominant {
+		// PHD2 corrects positive Dec distances with south pulses.
+		r.DecGuideMode = DecGuideModeSouth
+		if result.DecDrift < 0 {
+			r.DecGuideMode = DecGuideModeNorth
+		}
+	}
+
+	return r
+}
+
+// Apply sets the recommended minimum moves and RA aggressiveness on the guide
+// algorithms in use, and the Dec guide mode. Parameters the algorithms do not
+// have are skipped. The aggressiveness is converted to a fraction for the
+// algorithms that take one.
+func (r GuidingRecommendations) Apply(c *RPCClient) error {
+	err := setAlgorithmParamLike(c, AxisRA, "minmove", r.RAMinMove)
+	if err != nil {
+		return err
+	}
+
+	err = setAlgorithmParamLike(c, AxisDec, "minmove", r.DecMinMove)
+	if err != nil {
+		return err
+	}
+
+	err = r.applyRAAggressiveness(c)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(c.SetDecGuideMode(r.DecGuideMode), "error setting Dec guide mode")
+}
+
+// applyRAAggressiveness sets the RA aggressiveness on the RA algorithm in use.
+// Lowpass2 takes a percentage, while Hysteresis and Resist Switch take a
+// fraction; other algorithms have no such setting.
+func (r GuidingRecommendations) applyRAAggressiveness(c *RPCClient) error {
+	algorithm, err := GetGuideAlgorithm(c, AxisRA)
+	if err != nil {
+		return err
+	}
+
+	var name string
+	value := r.RAAggressiveness
+
+	switch algorithm {
+	case GuideAlgorithmLowPass2:
+		name = "aggressiveness"
+	case GuideAlgorithmHysteresis, GuideAlgorithmResistSwitch:
+		name = aggressionParam.Name
+		value /= 100
+	default:
+		return nil
+	}
+
+	return errors.Wrapf(c.SetAlgorithmParam(AxisRA, name, value), "error setting %s %s", AxisRA, name)
+}
+
+// setAlgorithmParamLike sets the first guide algorithm parameter whose name
+// starts with prefix, ignoring case, as algorithms name the same setting
+// differently.
+func setAlgorithmParamLike(c *RPCClient, axis Axis, prefix string, value float64) error {
+	names, err := c.GetAlgorithmParamNames(axis)
+	if err != nil {
+		return errors.Wrapf(err, "error getting %s algorithm parameter names", axis)
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(strings.ToLower(name), prefix) {
+			return errors.Wrapf(c.SetAlgorithmParam(axis, name, value), "error setting %s %s", axis, name)
+		}
+	}
+
+	return nil
+}
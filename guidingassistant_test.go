@@ -0,0 +1,126 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestGuidingAssistant(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	a := phd2.NewGuidingAssistant(c, phd2.GuidingAssistantConfig{
+		Duration:   500 * time.Millisecond,
+		PixelScale: 2,
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, a)
+
+	var mutex sync.Mutex
+	calls := 0
+	fake.handle("set_guide_output_enabled", func([]json.RawMessage) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// Each measurement disables guide output first, then restores it.
+		calls++
+		if calls%2 == 1 {
+			go func() {
+				for i := 0; i < 21; i++ {
+					seeing := 0.5
+					if i%2 == 1 {
+						seeing = -0.5
+					}
+
+					// Guide steps every 3s, drifting 2 px/min in RA and
+					// -1 px/min in Dec.
+					fake.emit(&phd2.GuideStepEvent{
+						Event:          phd2.Event{Event: "GuideStep"},
+						Time:           float64(i) * 3,
+						RADistanceRaw:  float64(i)/10 + seeing,
+						DecDistanceRaw: -float64(i)/20 + seeing/5,
+					})
+				}
+			}()
+		}
+		return 0, nil
+	})
+
+	fake.result("get_guide_output_enabled", true)
+
+	result, err := a.Measure(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 21, result.Frames)
+	assert.Equal(t, time.Minute, result.Duration)
+	assert.Equal(t, 3*time.Second, result.Exposure)
+	assert.InDelta(t, 2, result.RADrift, 0.1)
+	assert.InDelta(t, 4, result.RADriftArcsec, 0.2)
+	assert.InDelta(t, -1, result.DecDrift, 0.1)
+	assert.InDelta(t, 0.5, result.RAHighFrequency, 0.05)
+	assert.InDelta(t, 0.1, result.DecHighFrequency, 0.01)
+	assert.True(t, result.DecDriftDominant)
+
+	r := result.Recommendations
+	assert.InDelta(t, 0.65*result.RAHighFrequency, r.RAMinMove, 1e-9)
+	assert.InDelta(t, 0.1*1.2, r.DecMinMove, 0.02)
+	assert.InDelta(t, 68, r.RAAggressiveness, 2)
+	assert.Equal(t, phd2.DecGuideModeNorth, r.DecGuideMode)
+
+	outputs := fake.callsTo("set_guide_output_enabled")
+	require.Len(t, outputs, 2)
+	assert.Equal(t, "false", string(outputs[0].Params[0]))
+	assert.Equal(t, "true", string(outputs[1].Params[0]))
+
+	// Guide output that was already disabled stays disabled.
+	fake.result("get_guide_output_enabled", false)
+	_, err = a.Measure(context.Background())
+	require.NoError(t, err)
+
+	outputs = fake.callsTo("set_guide_output_enabled")
+	require.Len(t, outputs, 4)
+	assert.Equal(t, "false", string(outputs[3].Params[0]))
+
+	fake.handle("get_algo_param_names", func(params []json.RawMessage) (interface{}, error) {
+		if string(params[0]) == `"ra"` {
+			return []string{"minMove", "hysteresis", "aggression"}, nil
+		}
+		return []string{"minMove", "fastSwitch"}, nil
+	})
+
+	fake.result("get_algo_param", "Hysteresis")
+
+	require.NoError(t, r.Apply(c))
+
+	sets := fake.callsTo("set_algo_param")
+	require.Len(t, sets, 3)
+	assert.Equal(t, `"dec"`, string(sets[1].Params[0]))
+	assert.Equal(t, `"minMove"`, string(sets[1].Params[1]))
+	assert.Equal(t, `"aggression"`, string(sets[2].Params[1]))
+
+	// Hysteresis takes the aggression as a fraction.
+	var aggression float64
+	require.NoError(t, json.Unmarshal(sets[2].Params[2], &aggression))
+	assert.InDelta(t, r.RAAggressiveness/100, aggression, 1e-9)
+
+	// Lowpass2 takes it as a percentage.
+	fake.result("get_algo_param", "Lowpass2")
+
+	require.NoError(t, r.Apply(c))
+
+	sets = fake.callsTo("set_algo_param")
+	require.Len(t, sets, 6)
+	assert.Equal(t, `"aggressiveness"`, string(sets[5].Params[1]))
+	require.NoError(t, json.Unmarshal(sets[5].Params[2], &aggression))
+	assert.InDelta(t, r.RAAggressiveness, aggression, 1e-9)
+	assert.Equal(t, `"North"`, string(fake.callsTo("set_dec_guide_mode")[0].Params[0]))
+}
@@ -0,0 +1,217 @@
+package phd2
+
+import (
+	"context"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// ImagingScale relates offsets in the imaging camera's frame to offsets in
+// the guide camera's frame.
+type ImagingScale struct {
+	// ImagingPixelScale is the imaging camera's scale in arc-sec/pixel.
+	ImagingPixelScale float64
+	// GuidePixelScale is the guide camera's scale in arc-sec/pixel, as
+	// returned by GetPixelScale.
+	GuidePixelScale float64
+	// Rotation is the angle in degrees, counter-clockwise, of the imaging
+	// camera's X axis in the guide camera's frame.
+	Rotation float64
+	// Mirrored is true if one camera sees the sky mirrored relative to the
+	// other, as with an off-axis guider.
+	Mirrored bool
+}
+
+// NewImagingScale creates an ImagingScale using the guide pixel scale reported
+// by PHD2.
+func NewImagingScale(c *RPCClient, imagingPixelScale, rotation float64, mirrored bool) (ImagingScale, error) {
+	guidePixelScale, err := c.GetPixelScale()
+	if err != nil {
+		return ImagingScale{}, errors.Wrap(err, "error getting pixel scale")
+	}
+
+	return ImagingScale{
+		ImagingPixelScale: imagingPixelScale,
+		GuidePixelScale:   guidePixelScale,
+		Rotation:          rotation,
+		Mirrored:          mirrored,
+	}, nil
+}
+
+// ToGuide converts an offset in imaging pixels to guide pixels.
+func (s ImagingScale) ToGuide(dx, dy float64) (float64, float64) {
+	if s.Mirrored {
+		dy = -dy
+	}
+
+	sin, cos := math.Sincos(s.Rotation * math.Pi / 180)
+	scale := s.ImagingPixelScale / s.GuidePixelScale
+
+	return scale * (dx*cos - dy*sin), scale * (dx*sin + dy*cos)
+}
+
+// ToImaging converts an offset in guide pixels to imaging pixels.
+func (s ImagingScale) ToImaging(dx, dy float64) (float64, float64) {
+	sin, cos := math.Sincos(s.Rotation * math.Pi / 180)
+	scale := s.GuidePixelScale / s.ImagingPixelScale
+
+	ix, iy := scale*(dx*cos+dy*sin), scale*(-dx*sin+dy*cos)
+
+	if s.Mirrored {
+		iy = -iy
+	}
+
+	return ix, iy
+}
+
+// ImagingDitherConfig configures an ImagingDitherer.
+type ImagingDitherConfig struct {
+	Scale ImagingScale
+	// DitherScale must match the dither scale set in the Brain. Defaults to 1.
+	DitherScale float64
+	// RAOnly restricts random dithers to the RA axis.
+	RAOnly bool
+	// Settle decides when guiding has settled after a dither or move.
+	Settle Settle
+	// AmountFactor multiplies the minimum offset to give the amount for
+	// random dithers. PHD2 dithers by a random amount up to the requested
+	// one on each axis, so a larger factor makes retries less likely.
+	// Defaults to 2.
+	AmountFactor float64
+	// MaxAttempts is how many random dithers to try before giving up.
+	// Defaults to 3.
+	MaxAttempts int
+}
+
+// ImagingDitherResult describes a dither made by an ImagingDitherer.
+type ImagingDitherResult struct {
+	// GuideDX and GuideDY are the offset in guide pixels.
+	GuideDX float64
+	GuideDY float64
+	// ImagingDX and ImagingDY are the offset in imaging pixels.
+	ImagingDX float64
+	ImagingDY float64
+	// Attempts is the number of dithers made.
+	Attempts int
+}
+
+// ImagingDitherer dithers by offsets stated in imaging camera pixels.
+//
+// ImagingDitherer must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type ImagingDitherer struct {
+	c      *RPCClient
+	config ImagingDitherConfig
+	queue  *eventQueue
+}
+
+// NewImagingDitherer creates a new ImagingDitherer.
+func NewImagingDitherer(c *RPCClient, config ImagingDitherConfig) *ImagingDitherer {
+	if config.DitherScale <= 0 {
+		config.DitherScale = 1
+	}
+
+	if config.AmountFactor <= 0 {
+		config.AmountFactor = 2
+	}
+
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 3
+	}
+
+	return &ImagingDitherer{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent queues events for dithering.
+func (d *ImagingDitherer) HandleEvent(evt interface{}) {
+	d.queue.HandleEvent(evt)
+}
+
+// MoveLockPosition moves the lock position exactly by an offset in imaging
+// pixels and waits for guiding to settle.
+func (d *ImagingDitherer) MoveLockPosition(ctx context.Context, dx, dy float64) (ImagingDitherResult, error) {
+	result := ImagingDitherResult{
+		ImagingDX: dx,
+		ImagingDY: dy,
+		Attempts:  1,
+	}
+
+	result.GuideDX, result.GuideDY = d.config.Scale.ToGuide(dx, dy)
+
+	lock, err := d.c.GetLockPositionF()
+	if err != nil {
+		return result, errors.Wrap(err, "error getting lock position")
+	}
+
+	if lock == nil {
+		return result, errors.New("no lock position to move")
+	}
+
+	d.queue.clear()
+
+	err = d.c.SetLockPosition(lock.X+result.GuideDX, lock.Y+result.GuideDY, true)
+	if err != nil {
+		return result, errors.Wrap(err, "error setting lock position")
+	}
+
+	return result, errors.Wrap(d.queue.waitForGuideSettle(ctx, d.config.Settle), "error waiting for settling")
+}
+
+// DitherAtLeast makes random dithers until one, as reported by the
+// GuidingDithered event, moves at least minPixels imaging pixels, and waits for
+// guiding to settle after each.
+func (d *ImagingDitherer) DitherAtLeast(ctx context.Context, minPixels float64) (ImagingDitherResult, error) {
+	var result ImagingDitherResult
+
+	guideX, guideY := d.config.Scale.ToGuide(minPixels, 0)
+	amount := math.Hypot(guideX, guideY) * d.config.AmountFactor
+
+	for result.Attempts < d.config.MaxAttempts {
+		result.Attempts++
+
+		d.queue.clear()
+
+		// PHD2 multiplies the amount by the dither scale.
+		err := d.c.Dither(amount/d.config.DitherScale, d.config.RAOnly, d.config.Settle)
+		if err != nil {
+			return result, errors.Wrap(err, "error dithering")
+		}
+
+		var dithered *GuidingDitheredEvent
+
+		err = d.queue.waitFor(ctx, func(evt interface{}) (bool, error) {
+			switch e := evt.(type) {
+			case *GuidingDitheredEvent:
+				dithered = e
+			case *SettleDoneEvent:
+				if e.Status != 0 {
+					return true, errors.Wrap(ErrSettleFailed, e.Error)
+				}
+				return true, nil
+			}
+
+			return false, nil
+		})
+		if err != nil {
+			return result, errors.Wrap(err, "error waiting for settling")
+		}
+
+		if dithered == nil {
+			return result, errors.New("no dither was reported")
+		}
+
+		result.GuideDX, result.GuideDY = dithered.DX, dithered.DY
+		result.ImagingDX, result.ImagingDY = d.config.Scale.ToImaging(dithered.DX, dithered.DY)
+
+		if math.Hypot(result.ImagingDX, result.ImagingDY) >= minPixels {
+			return result, nil
+		}
+	}
+
+	return result, errors.Errorf("dither moved less than %g imaging pixels after %d attempts", minPixels, result.Attempts)
+}
@@ -0,0 +1,128 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestImagingScale(t *testing.T) {
+	s := phd2.ImagingScale{
+		ImagingPixelScale: 1,
+		GuidePixelScale:   4,
+		Rotation:          90,
+	}
+
+	gx, gy := s.ToGuide(12, 0)
+	assert.InDelta(t, 0, gx, 1e-9)
+	assert.InDelta(t, 3, gy, 1e-9)
+
+	for _, mirrored := range []bool{false, true} {
+		s := phd2.ImagingScale{
+			ImagingPixelScale: 1.2,
+			GuidePixelScale:   3.5,
+			Rotation:          -37,
+			Mirrored:          mirrored,
+		}
+
+		ix, iy := s.ToImaging(s.ToGuide(7, -3))
+		assert.InDelta(t, 7, ix, 1e-9)
+		assert.InDelta(t, -3, iy, 1e-9)
+	}
+}
+
+func TestImagingDithererDitherAtLeast(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	d := phd2.NewImagingDitherer(c, phd2.ImagingDitherConfig{
+		Scale: phd2.ImagingScale{
+			ImagingPixelScale: 1,
+			GuidePixelScale:   4,
+		},
+		DitherScale: 0.5,
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, d)
+
+	moves := []float64{1, 3.5}
+	fake.handle("dither", func([]json.RawMessage) (interface{}, error) {
+		dx := moves[0]
+		moves = moves[1:]
+
+		go func() {
+			fake.emit(&phd2.GuidingDitheredEvent{Event: phd2.Event{Event: "GuidingDithered"}, DX: dx, DY: 0})
+			fake.emit(&phd2.SettleDoneEvent{Event: phd2.Event{Event: "SettleDone"}})
+		}()
+		return 0, nil
+	})
+
+	result, err := d.DitherAtLeast(context.Background(), 12)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Attempts)
+	assert.InDelta(t, 14, result.ImagingDX, 1e-9)
+
+	dithers := fake.callsTo("dither")
+	require.Len(t, dithers, 2)
+	// 12 imaging pixels is 3 guide pixels, doubled and divided by the dither
+	// scale.
+	assert.Equal(t, "12", string(dithers[0].Params[0]))
+}
+
+func TestImagingDithererMoveLockPosition(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	d := phd2.NewImagingDitherer(c, phd2.ImagingDitherConfig{
+		Scale: phd2.ImagingScale{
+			ImagingPixelScale: 1,
+			GuidePixelScale:   4,
+		},
+		Settle: phd2.Settle{Pixels: 0.5, TimeSeconds: 0, TimeoutSeconds: 10},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, d)
+
+	var mutex sync.Mutex
+	settled := false
+
+	fake.result("get_lock_position", []float64{100.5, 60.25})
+	fake.handle("set_lock_position", func([]json.RawMessage) (interface{}, error) {
+		go func() {
+			fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}, DX: 2})
+
+			mutex.Lock()
+			settled = true
+			mutex.Unlock()
+
+			fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}, DX: 0.2})
+		}()
+		return 0, nil
+	})
+
+	result, err := d.MoveLockPosition(context.Background(), 8, -4)
+	require.NoError(t, err)
+	assert.InDelta(t, 2, result.GuideDX, 1e-9)
+	assert.InDelta(t, -1, result.GuideDY, 1e-9)
+
+	mutex.Lock()
+	assert.True(t, settled, "returns once guiding has settled")
+	mutex.Unlock()
+
+	// 8, -4 imaging pixels is 2, -1 guide pixels from the lock position.
+	locks := fake.callsTo("set_lock_position")
+	require.Len(t, locks, 1)
+	assert.Equal(t, "102.5", string(locks[0].Params[0]))
+	assert.Equal(t, "59.25", string(locks[0].Params[1]))
+	assert.Equal(t, "true", string(locks[0].Params[2]))
+}
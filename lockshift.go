@@ -0,0 +1,200 @@
+package phd2
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LockShiftBuilder builds LockShiftParams from an object's apparent motion
+// relative to the stars, such as a comet's or asteroid's from its ephemeris.
+//
+//	params, err := phd2.NewLockShiftBuilder().
+//		RACoordinateRate(raSecondsPerHour, decArcsecPerHour, dec).
+//		Build()
+type LockShiftBuilder struct {
+	rate       [2]float64
+	units      LockShiftUnits
+	axes       LockShiftAxes
+	pixelScale float64
+	err        error
+}
+
+// NewLockShiftBuilder creates a builder for a lock shift with no motion.
+func NewLockShiftBuilder() *LockShiftBuilder {
+	return &LockShiftBuilder{
+		units: LockShiftUnitsArcsecPerHour,
+		axes:  LockShiftAxesRADec,
+	}
+}
+
+// SkyRate sets the motion along RA and Dec on the sky in arc-sec/hour. The RA
+// rate is the motion on the sky, which some ephemerides give as dRA*cos(Dec).
+func (b *LockShiftBuilder) SkyRate(ra, dec float64) *LockShiftBuilder {
+	b.rate = [2]float64{ra, dec}
+	b.units = LockShiftUnitsArcsecPerHour
+	b.axes = LockShiftAxesRADec
+	return b
+}
+
+// RACoordinateRate sets the motion from the rate of change of the RA
+// coordinate in seconds of time/hour, as most ephemerides give it, the Dec
+// rate in arc-sec/hour and the object's declination in degrees.
+func (b *LockShiftBuilder) RACoordinateRate(raSecondsPerHour, decArcsecPerHour, declination float64) *LockShiftBuilder {
+	if math.Abs(declination) >= 90 {
+		b.err = errors.Errorf("declination out of range: %g", declination)
+	}
+
+	ra := raSecondsPerHour * 15 * math.Cos(declination*math.Pi/180)
+	return b.SkyRate(ra, decArcsecPerHour)
+}
+
+// CameraRate sets the motion along the guide camera's X and Y axes.
+func (b *LockShiftBuilder) CameraRate(x, y float64, units LockShiftUnits) *LockShiftBuilder {
+	b.rate = [2]float64{x, y}
+	b.units = units
+	b.axes = LockShiftAxesXY
+	return b
+}
+
+// InPixels makes Build convert the rates to pixels/hour using a pixel scale in
+// arc-sec/pixel, as returned by GetPixelScale.
+func (b *LockShiftBuilder) InPixels(pixelScale float64) *LockShiftBuilder {
+	if pixelScale <= 0 {
+		b.err = errors.Errorf("invalid pixel scale: %g", pixelScale)
+	}
+
+	b.pixelScale = pixelScale
+	return b
+}
+
+// Build returns the lock shift, enabled.
+func (b *LockShiftBuilder) Build() (LockShiftParams, error) {
+	if b.err != nil {
+		return LockShiftParams{}, b.err
+	}
+
+	switch b.units {
+	case LockShiftUnitsArcsecPerHour, LockShiftUnitsPixelsPerHour:
+	default:
+		return LockShiftParams{}, errors.Errorf("invalid lock shift units: %q", b.units)
+	}
+
+	rate := b.rate
+	units := b.units
+
+	if b.pixelScale > 0 && units == LockShiftUnitsArcsecPerHour {
+		rate[0] /= b.pixelScale
+		rate[1] /= b.pixelScale
+		units = LockShiftUnitsPixelsPerHour
+	}
+
+	for _, r := range rate {
+		if math.IsNaN(r) || math.IsInf(r, 0) {
+			return LockShiftParams{}, errors.Errorf("invalid lock shift rate: %g", r)
+		}
+	}
+
+	return LockShiftParams{
+		Enabled: true,
+		Rate:    rate[:],
+		Units:   units,
+		Axes:    b.axes,
+	}, nil
+}
+
+// LockShiftTrackerConfig configures a LockShiftTracker.
+type LockShiftTrackerConfig struct {
+	// Rates returns the lock shift for a time, typically from an ephemeris
+	// with a LockShiftBuilder.
+	Rates func(time.Time) (LockShiftParams, error)
+	// Interval is how often the rates are updated. Defaults to 5 minutes.
+	Interval time.Duration
+	// DisableOnStop disables lock shift when Run returns.
+	DisableOnStop bool
+
+	// OnUpdate, if set, is called every time the lock shift is set. It is
+	// called from the goroutine running Run.
+	OnUpdate func(LockShiftParams)
+}
+
+// LockShiftTracker keeps the lock shift up to date with an object whose
+// apparent motion changes over time.
+type LockShiftTracker struct {
+	c      *RPCClient
+	config LockShiftTrackerConfig
+}
+
+// NewLockShiftTracker creates a new LockShiftTracker.
+func NewLockShiftTracker(c *RPCClient, config LockShiftTrackerConfig) *LockShiftTracker {
+	if config.Interval <= 0 {
+		config.Interval = 5 * time.Minute
+	}
+
+	return &LockShiftTracker{
+		c:      c,
+		config: config,
+	}
+}
+
+// Run sets the lock shift now and every interval until the context is done or
+// setting it fails. The lock shift is only set again when the rates change.
+func (t *LockShiftTracker) Run(ctx context.Context) (err error) {
+	if t.config.DisableOnStop {
+		defer func() {
+			disableErr := t.c.SetLockShiftEnabled(false)
+			if disableErr != nil && err == ctx.Err() {
+				err = errors.Wrap(disableErr, "error disabling lock shift")
+			}
+		}()
+	}
+
+	var last *LockShiftParams
+
+	for {
+		params, err := t.config.Rates(time.Now())
+		if err != nil {
+			return errors.Wrap(err, "error getting lock shift rates")
+		}
+
+		if last == nil || !lockShiftEqual(*last, params) {
+			err = t.c.SetLockShiftParams(params)
+			if err != nil {
+				return errors.Wrap(err, "error setting lock shift params")
+			}
+
+			err = t.c.SetLockShiftEnabled(params.Enabled)
+			if err != nil {
+				return errors.Wrap(err, "error enabling lock shift")
+			}
+
+			last = &params
+
+			if t.config.OnUpdate != nil {
+				t.config.OnUpdate(params)
+			}
+		}
+
+		select {
+		case <-time.After(t.config.Interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func lockShiftEqual(a, b LockShiftParams) bool {
+	if a.Enabled != b.Enabled || a.Units != b.Units || a.Axes != b.Axes || len(a.Rate) != len(b.Rate) {
+		return false
+	}
+
+	for i := range a.Rate {
+		if a.Rate[i] != b.Rate[i] {
+			return false
+		}
+	}
+
+	return true
+}
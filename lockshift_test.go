@@ -0,0 +1,120 @@
+package phd2_test
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestLockShiftBuilder(t *testing.T) {
+	type testCase struct {
+		name    string
+		builder *phd2.LockShiftBuilder
+		params  phd2.LockShiftParams
+		err     bool
+	}
+
+	testCases := []testCase{
+		{
+			name:    "sky rate",
+			builder: phd2.NewLockShiftBuilder().SkyRate(12, -3),
+			params:  phd2.LockShiftParams{Enabled: true, Rate: []float64{12, -3}, Units: phd2.LockShiftUnitsArcsecPerHour, Axes: phd2.LockShiftAxesRADec},
+		},
+		{
+			name:    "RA coordinate rate in pixels",
+			builder: phd2.NewLockShiftBuilder().RACoordinateRate(2, 30, 60).InPixels(1.5),
+			params:  phd2.LockShiftParams{Enabled: true, Rate: []float64{10, 20}, Units: phd2.LockShiftUnitsPixelsPerHour, Axes: phd2.LockShiftAxesRADec},
+		},
+		{
+			name:    "camera rate",
+			builder: phd2.NewLockShiftBuilder().CameraRate(1, 2, phd2.LockShiftUnitsPixelsPerHour),
+			params:  phd2.LockShiftParams{Enabled: true, Rate: []float64{1, 2}, Units: phd2.LockShiftUnitsPixelsPerHour, Axes: phd2.LockShiftAxesXY},
+		},
+		{
+			name:    "invalid units",
+			builder: phd2.NewLockShiftBuilder().CameraRate(1, 2, "px/min"),
+			err:     true,
+		},
+		{
+			name:    "at the pole",
+			builder: phd2.NewLockShiftBuilder().RACoordinateRate(2, 30, 90),
+			err:     true,
+		},
+		{
+			name:    "not a number",
+			builder: phd2.NewLockShiftBuilder().SkyRate(math.NaN(), 0),
+			err:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := tc.builder.Build()
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.params.Units, params.Units)
+			assert.Equal(t, tc.params.Axes, params.Axes)
+			assert.True(t, params.Enabled)
+			require.Len(t, params.Rate, 2)
+			assert.InDelta(t, tc.params.Rate[0], params.Rate[0], 1e-9)
+			assert.InDelta(t, tc.params.Rate[1], params.Rate[1], 1e-9)
+		})
+	}
+}
+
+func TestLockShiftTracker(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	var mutex sync.Mutex
+	calls := 0
+
+	tracker := phd2.NewLockShiftTracker(c, phd2.LockShiftTrackerConfig{
+		Rates: func(time.Time) (phd2.LockShiftParams, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			// The rate changes every other update.
+			calls++
+			return phd2.NewLockShiftBuilder().SkyRate(float64(calls/2), 1).Build()
+		},
+		Interval:      5 * time.Millisecond,
+		DisableOnStop: true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- tracker.Run(ctx)
+	}()
+
+	waitUntil(t, func() bool {
+		return len(fake.callsTo("set_lock_shift_params")) >= 3
+	})
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	params := fake.callsTo("set_lock_shift_params")
+	assert.True(t, calls >= 2*len(params)-2, "only changed rates are set")
+	assert.JSONEq(t, `{"enabled":true,"rate":[0,1],"units":"arcsec/hr","axes":"RA/Dec"}`, string(params[0].Params[0]))
+	assert.JSONEq(t, `{"enabled":true,"rate":[1,1],"units":"arcsec/hr","axes":"RA/Dec"}`, string(params[1].Params[0]))
+
+	enables := fake.callsTo("set_lock_shift_enabled")
+	assert.Equal(t, "true", string(enables[0].Params[0]))
+	assert.Equal(t, "false", string(enables[len(enables)-1].Params[0]))
+}
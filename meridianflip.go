@@ -0,0 +1,242 @@
+package phd2
+
+import (
+	"context"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// FlipStrategy is how MeridianFlip deals with calibration after a flip.
+type FlipStrategy string
+
+const (
+	// FlipStrategyFlipCalibration flips the existing calibration, falling
+	// back to recalibrating if the flipped angles do not check out.
+	FlipStrategyFlipCalibration = FlipStrategy("flip")
+	// FlipStrategyRecalibrate clears the calibration and recalibrates.
+	FlipStrategyRecalibrate = FlipStrategy("recalibrate")
+)
+
+// MeridianFlipConfig configures a MeridianFlip.
+type MeridianFlipConfig struct {
+	Strategy FlipStrategy
+	// AngleTolerance is how far, in degrees, the RA and Dec angles may be from
+	// having changed by exactly 180 degrees. Defaults to 10.
+	AngleTolerance float64
+	// Settle is used when restarting guiding.
+	Settle Settle
+	// LoopFrames is the number of frames to wait for before restoring the lock
+	// position. Defaults to 3.
+	LoopFrames int
+}
+
+// MeridianFlipResult describes what MeridianFlip did.
+type MeridianFlipResult struct {
+	// Before is the calibration from before the flip.
+	Before CalibrationData
+	// After is the calibration guiding was restarted with.
+	After CalibrationData
+	// AlreadyFlipped is true if PHD2 had flipped the calibration on its own,
+	// e.g. because it knows the pier side, so it was not flipped again.
+	AlreadyFlipped bool
+	// Recalibrated is true if the calibration was cleared and redone.
+	Recalibrated bool
+	// LockPosition is the lock position that was restored, if there was one.
+	LockPosition *LockPosition
+}
+
+// MeridianFlip restarts guiding after a meridian flip. Call Snapshot before the
+// mount flips and Complete after, so the calibration from before the flip can
+// be compared against and flipping twice avoided.
+//
+// MeridianFlip must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type MeridianFlip struct {
+	c      *RPCClient
+	config MeridianFlipConfig
+	queue  *eventQueue
+
+	before *CalibrationData
+	lock   *LockPosition
+}
+
+// NewMeridianFlip creates a new MeridianFlip.
+func NewMeridianFlip(c *RPCClient, config MeridianFlipConfig) *MeridianFlip {
+	if config.AngleTolerance <= 0 {
+		config.AngleTolerance = 10
+	}
+
+	if config.LoopFrames <= 0 {
+		config.LoopFrames = 3
+	}
+
+	return &MeridianFlip{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent queues events for Complete.
+func (f *MeridianFlip) HandleEvent(evt interface{}) {
+	f.queue.HandleEvent(evt)
+}
+
+// Snapshot records the calibration and lock position before the flip.
+func (f *MeridianFlip) Snapshot() error {
+	before, err := f.c.GetCalibrationData(MountTypeMount)
+	if err != nil {
+		return errors.Wrap(err, "error getting calibration data")
+	}
+
+	lock, err := f.c.GetLockPositionF()
+	if err != nil {
+		return errors.Wrap(err, "error getting lock position")
+	}
+
+	f.before = &before
+	f.lock = lock
+
+	return nil
+}
+
+// Complete deals with the calibration according to the strategy, restores
+// the lock position, restarts guiding and waits for it to settle.
+func (f *MeridianFlip) Complete(ctx context.Context) (MeridianFlipResult, error) {
+	var result MeridianFlipResult
+
+	if f.before == nil {
+		return result, errors.New("no snapshot from before the flip")
+	}
+
+	result.Before = *f.before
+	result.LockPosition = f.lock
+
+	err := f.c.StopCapture()
+	if err != nil {
+		return result, errors.Wrap(err, "error stopping capture")
+	}
+
+	err = waitForAppState(ctx, f.c, AppStateStopped)
+	if err != nil {
+		return result, errors.Wrap(err, "error waiting for capture to stop")
+	}
+
+	recalibrate := f.config.Strategy == FlipStrategyRecalibrate || !result.Before.Calibrated
+
+	if !recalibrate {
+		result.After, result.AlreadyFlipped, err = f.flip(result.Before)
+		if err != nil {
+			return result, err
+		}
+
+		recalibrate = !CalibrationFlipped(result.Before, result.After, f.config.AngleTolerance)
+	}
+
+	if recalibrate {
+		err = f.c.ClearCalibration(MountTypeMount)
+		if err != nil {
+			return result, errors.Wrap(err, "error clearing calibration")
+		}
+
+		result.Recalibrated = true
+	}
+
+	err = f.guide(ctx, result.LockPosition, recalibrate)
+	if err != nil {
+		return result, err
+	}
+
+	if recalibrate {
+		result.After, err = f.c.GetCalibrationData(MountTypeMount)
+		if err != nil {
+			return result, errors.Wrap(err, "error getting calibration data")
+		}
+	}
+
+	f.before = nil
+
+	return result, nil
+}
+
+// flip flips the calibration unless PHD2 already has.
+func (f *MeridianFlip) flip(before CalibrationData) (CalibrationData, bool, error) {
+	current, err := f.c.GetCalibrationData(MountTypeMount)
+	if err != nil {
+		return current, false, errors.Wrap(err, "error getting calibration data")
+	}
+
+	if CalibrationFlipped(before, current, f.config.AngleTolerance) {
+		return current, true, nil
+	}
+
+	err = f.c.FlipCalibration()
+	if err != nil {
+		return current, false, errors.Wrap(err, "error flipping calibration")
+	}
+
+	current, err = f.c.GetCalibrationData(MountTypeMount)
+	return current, false, errors.Wrap(err, "error getting calibration data")
+}
+
+func (f *MeridianFlip) guide(ctx context.Context, lock *LockPosition, recalibrate bool) error {
+	return restartGuiding(ctx, f.c, f.queue, lock, f.config.LoopFrames, f.config.Settle, recalibrate)
+}
+
+// restartGuiding starts looping and, if lock is not nil, selects the star
+// nearest it once loopFrames frames have been taken. It then starts guiding and
+// waits for settling.
+func restartGuiding(ctx context.Context, c *RPCClient, q *eventQueue, lock *LockPosition, loopFrames int, settle Settle, recalibrate bool) error {
+	q.clear()
+
+	err := c.Loop()
+	if err != nil {
+		return errors.Wrap(err, "error starting looping")
+	}
+
+	if lock != nil {
+		err = q.waitForFrames(ctx, loopFrames)
+		if err != nil {
+			return errors.Wrap(err, "error waiting for frames")
+		}
+
+		// Not exact, so that the star nearest the old lock position is
+		// selected.
+		err = c.SetLockPosition(lock.X, lock.Y, false)
+		if err != nil {
+			return errors.Wrap(err, "error restoring lock position")
+		}
+	}
+
+	q.clear()
+
+	err = c.Guide(settle, recalibrate)
+	if err != nil {
+		return errors.Wrap(err, "error starting guiding")
+	}
+
+	return errors.Wrap(q.waitForSettle(ctx), "error waiting for settling")
+}
+
+// CalibrationFlipped returns true if the RA angle of after is within tolerance
+// degrees of being 180 degrees from that of before. PHD2 only flips RA by
+// default, so the Dec angle may be either unchanged or flipped, within the same
+// tolerance.
+func CalibrationFlipped(before, after CalibrationData, tolerance float64) bool {
+	dec := angleDifference(before.YAngle, after.YAngle)
+
+	return math.Abs(180-angleDifference(before.XAngle, after.XAngle)) <= tolerance &&
+		(dec <= tolerance || math.Abs(180-dec) <= tolerance)
+}
+
+// angleDifference returns the absolute difference between two angles in
+// degrees, between 0 and 180.
+func angleDifference(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 360)
+	if d > 180 {
+		d = 360 - d
+	}
+
+	return d
+}
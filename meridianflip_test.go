@@ -0,0 +1,160 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestCalibrationFlipped(t *testing.T) {
+	type testCase struct {
+		name string
+
+		before phd2.CalibrationData
+		after  phd2.CalibrationData
+
+		expectedResult bool
+	}
+
+	testCases := []testCase{
+		testCase{
+			name:           "Flipped",
+			before:         phd2.CalibrationData{XAngle: 10, YAngle: 100},
+			after:          phd2.CalibrationData{XAngle: -170, YAngle: -80},
+			expectedResult: true,
+		},
+		testCase{
+			name:           "FlippedAcrossWrap",
+			before:         phd2.CalibrationData{XAngle: 175, YAngle: -95},
+			after:          phd2.CalibrationData{XAngle: -3, YAngle: 88},
+			expectedResult: true,
+		},
+		testCase{
+			name:           "Unchanged",
+			before:         phd2.CalibrationData{XAngle: 10, YAngle: 100},
+			after:          phd2.CalibrationData{XAngle: 11, YAngle: 99},
+			expectedResult: false,
+		},
+		testCase{
+			name:           "OnlyRAFlipped",
+			before:         phd2.CalibrationData{XAngle: 10, YAngle: 100},
+			after:          phd2.CalibrationData{XAngle: -170, YAngle: 100},
+			expectedResult: true,
+		},
+		testCase{
+			name:           "OnlyDecFlipped",
+			before:         phd2.CalibrationData{XAngle: 10, YAngle: 100},
+			after:          phd2.CalibrationData{XAngle: 10, YAngle: -80},
+			expectedResult: false,
+		},
+		testCase{
+			name:           "DecRotated",
+			before:         phd2.CalibrationData{XAngle: 10, YAngle: 100},
+			after:          phd2.CalibrationData{XAngle: -170, YAngle: 10},
+			expectedResult: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedResult, phd2.CalibrationFlipped(tc.before, tc.after, 10))
+		})
+	}
+}
+
+func TestMeridianFlip(t *testing.T) {
+	type testCase struct {
+		name string
+
+		phdFlips bool
+
+		expectedFlips          int
+		expectedAlreadyFlipped bool
+	}
+
+	testCases := []testCase{
+		testCase{
+			name:          "Flip",
+			expectedFlips: 1,
+		},
+		testCase{
+			name:                   "AlreadyFlipped",
+			phdFlips:               true,
+			expectedFlips:          0,
+			expectedAlreadyFlipped: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, fake := newFakePHD2(t)
+			defer fake.close()
+
+			f := phd2.NewMeridianFlip(c, phd2.MeridianFlipConfig{
+				Strategy:   phd2.FlipStrategyFlipCalibration,
+				LoopFrames: 1,
+			})
+
+			events, err := c.Subscribe()
+			require.NoError(t, err)
+			go phd2.DispatchEvents(events, f)
+
+			var mutex sync.Mutex
+			flipped := false
+
+			fake.handle("get_calibration_data", func([]json.RawMessage) (interface{}, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				if flipped {
+					return phd2.CalibrationData{Calibrated: true, XAngle: -170, YAngle: -80}, nil
+				}
+				return phd2.CalibrationData{Calibrated: true, XAngle: 10, YAngle: 100}, nil
+			})
+			fake.handle("flip_calibration", func([]json.RawMessage) (interface{}, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				flipped = !flipped
+				return 0, nil
+			})
+			fake.result("get_lock_position", []float64{320.5, 240.25})
+			fake.result("get_app_state", "Stopped")
+			fake.handle("loop", func([]json.RawMessage) (interface{}, error) {
+				go fake.emit(&phd2.LoopingExposuresEvent{Event: phd2.Event{Event: "LoopingExposures"}, Frame: 1})
+				return 0, nil
+			})
+			fake.handle("guide", func([]json.RawMessage) (interface{}, error) {
+				go fake.emit(&phd2.SettleDoneEvent{Event: phd2.Event{Event: "SettleDone"}})
+				return 0, nil
+			})
+
+			require.NoError(t, f.Snapshot())
+
+			if tc.phdFlips {
+				mutex.Lock()
+				flipped = true
+				mutex.Unlock()
+			}
+
+			result, err := f.Complete(context.Background())
+			require.NoError(t, err)
+
+			assert.Len(t, fake.callsTo("flip_calibration"), tc.expectedFlips)
+			assert.Equal(t, tc.expectedAlreadyFlipped, result.AlreadyFlipped)
+			assert.False(t, result.Recalibrated)
+			assert.Equal(t, -170.0, result.After.XAngle)
+
+			locks := fake.callsTo("set_lock_position")
+			require.Len(t, locks, 1)
+			assert.Equal(t, "320.5", string(locks[0].Params[0]))
+			assert.Equal(t, "240.25", string(locks[0].Params[1]))
+		})
+	}
+}
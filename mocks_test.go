@@ -89,3 +89,13 @@ func (m *MockConn) SetWriteDeadline(t time.Time) error {
 	args := m.Called(t)
 	return args.Error(0)
 }
+
+// pipeDialer hands out one end of an in-memory connection, so clients can be
+// tested against a fake PHD2 running on the other end.
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d *pipeDialer) Dial(network, address string) (net.Conn, error) {
+	return d.conn, nil
+}
@@ -0,0 +1,292 @@
+package phd2
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeriodicErrorConfig configures periodic error analysis.
+type PeriodicErrorConfig struct {
+	// PixelScale is the pixel scale in arc-sec/pixel, as returned by
+	// GetPixelScale. If 0, amplitudes are only given in pixels.
+	PixelScale float64
+	// MinPeriod and MaxPeriod bound the periods searched. They default to
+	// twice the mean interval between guide steps and half the length of the
+	// session, the shortest period that can be resolved and the longest that
+	// repeats at least twice.
+	MinPeriod time.Duration
+	MaxPeriod time.Duration
+	// Oversampling is how many trial frequencies the coarse search makes per
+	// frequency resolution of the session, one over its length, so longer
+	// sessions are searched more finely. Each peak is then refined. Defaults
+	// to 5.
+	Oversampling float64
+	// Components is the number of dominant periods reported. Defaults to 5.
+	Components int
+	// MinWormPeriod and MaxWormPeriod bound the period taken to be the worm
+	// period. They default to 100s and 1200s, which cover most mounts.
+	MinWormPeriod time.Duration
+	MaxWormPeriod time.Duration
+}
+
+// PeriodicComponent is a periodic component of the RA error.
+type PeriodicComponent struct {
+	Period time.Duration
+	// Amplitude is the semi-amplitude of the best fitting sine wave in pixels,
+	// so the peak to peak error is twice it.
+	Amplitude       float64
+	AmplitudeArcsec float64
+	// Power is the fraction of the variance of the RA error explained by the
+	// sine wave.
+	Power float64
+}
+
+// PeriodicErrorReport is the result of periodic error analysis.
+type PeriodicErrorReport struct {
+	Frames   int
+	Duration time.Duration
+	// Components are the dominant periodic components, strongest first.
+	Components []PeriodicComponent
+	// WormPeriod is the period of the strongest component within the worm
+	// period bounds, or 0 if there is none.
+	WormPeriod time.Duration
+}
+
+// AnalyzePeriodicError finds the periodic components of the RA error in guide
+// steps using a Lomb-Scargle periodogram, which unlike an FFT copes with the
+// uneven intervals between guide steps. Linear drift is removed first.
+//
+// While guiding, the RA error is what remains after corrections, so the
+// periodic error of the mount itself is best measured with guide output
+// disabled or with low aggressiveness.
+func AnalyzePeriodicError(steps []*GuideStepEvent, config PeriodicErrorConfig) PeriodicErrorReport {
+	config = config.withDefaults()
+
+	report := PeriodicErrorReport{
+		Frames: len(steps),
+	}
+
+	if len(steps) < 4 {
+		return report
+	}
+
+	times := make([]float64, len(steps))
+	ra := make([]float64, len(steps))
+
+	for i, step := range steps {
+		times[i] = step.Time
+		ra[i] = step.RADistanceRaw
+	}
+
+	span := times[len(times)-1] - times[0]
+	report.Duration = time.Duration(span * float64(time.Second))
+
+	if span <= 0 {
+		return report
+	}
+
+	slope, intercept, _ := linearFit(times, ra)
+	for i := range ra {
+		ra[i] -= slope*times[i] + intercept
+	}
+
+	variance := stdDev(ra) * stdDev(ra)
+	if variance == 0 {
+		return report
+	}
+
+	minPeriod := config.MinPeriod.Seconds()
+	if minPeriod <= 0 {
+		minPeriod = 2 * span / float64(len(times)-1)
+	}
+
+	maxPeriod := config.MaxPeriod.Seconds()
+	if maxPeriod <= 0 {
+		maxPeriod = span / 2
+	}
+
+	if maxPeriod <= minPeriod {
+		return report
+	}
+
+	minFreq, maxFreq := 1/maxPeriod, 1/minPeriod
+
+	frequencies := int(math.Ceil(config.Oversampling*span*(maxFreq-minFreq))) + 1
+	if frequencies < 2 {
+		frequencies = 2
+	}
+	step := (maxFreq - minFreq) / float64(frequencies-1)
+
+	power := make([]float64, frequencies)
+	for i := range power {
+		power[i] = lombScargle(times, ra, minFreq+float64(i)*step).power
+	}
+
+	var peaks []int
+	for i := range power {
+		if (i == 0 || power[i] > power[i-1]) && (i == len(power)-1 || power[i] >= power[i+1]) {
+			peaks = append(peaks, i)
+		}
+	}
+
+	sort.Slice(peaks, func(i, j int) bool {
+		return power[peaks[i]] > power[peaks[j]]
+	})
+
+	if len(peaks) > config.Components {
+		peaks = peaks[:config.Components]
+	}
+
+	for _, i := range peaks {
+		// Refine the peak between its neighbouring trial frequencies.
+		best := lombScargleFit{}
+		for j := -20; j <= 20; j++ {
+			f := minFreq + (float64(i)+float64(j)/20)*step
+			if f <= 0 {
+				continue
+			}
+
+			fit := lombScargle(times, ra, f)
+			if fit.power > best.power {
+				best = fit
+			}
+		}
+
+		report.Components = append(report.Components, PeriodicComponent{
+			Period:          time.Duration(float64(time.Second) / best.frequency),
+			Amplitude:       best.amplitude,
+			AmplitudeArcsec: best.amplitude * config.PixelScale,
+			Power:           best.power / variance,
+		})
+	}
+
+	sort.Slice(report.Components, func(i, j int) bool {
+		return report.Components[i].Power > report.Components[j].Power
+	})
+
+	for _, c := range report.Components {
+		if c.Period >= config.MinWormPeriod && c.Period <= config.MaxWormPeriod {
+			report.WormPeriod = c.Period
+			break
+		}
+	}
+
+	return report
+}
+
+func (c PeriodicErrorConfig) withDefaults() PeriodicErrorConfig {
+	if c.Oversampling <= 0 {
+		c.Oversampling = 5
+	}
+
+	if c.Components <= 0 {
+		c.Components = 5
+	}
+
+	if c.MinWormPeriod <= 0 {
+		c.MinWormPeriod = 100 * time.Second
+	}
+
+	if c.MaxWormPeriod <= 0 {
+		c.MaxWormPeriod = 1200 * time.Second
+	}
+
+	return c
+}
+
+// lombScargleFit is the least squares sine wave fit at one frequency.
+type lombScargleFit struct {
+	frequency float64
+	amplitude float64
+	// power is the variance explained by the fit.
+	power float64
+}
+
+// lombScargle fits a sine wave of frequency f, in Hz, to values with a mean of
+// zero sampled at the given times.
+func lombScargle(times, values []float64, f float64) lombScargleFit {
+	w := 2 * math.Pi * f
+
+	// The time offset tau makes the sine and cosine terms orthogonal, so each
+	// can be fitted on its own.
+	var sin2, cos2 float64
+	for _, t := range times {
+		s, c := math.Sincos(2 * w * t)
+		sin2 += s
+		cos2 += c
+	}
+
+	tau := math.Atan2(sin2, cos2) / (2 * w)
+
+	var yc, ys, cc, ss float64
+	for i, t := range times {
+		s, c := math.Sincos(w * (t - tau))
+		yc += values[i] * c
+		ys += values[i] * s
+		cc += c * c
+		ss += s * s
+	}
+
+	var a, b float64
+	if cc > 0 {
+		a = yc / cc
+	}
+	if ss > 0 {
+		b = ys / ss
+	}
+
+	return lombScargleFit{
+		frequency: f,
+		amplitude: math.Hypot(a, b),
+		power:     (a*yc + b*ys) / float64(len(times)),
+	}
+}
+
+// PeriodicErrorAnalyzer collects guide steps for periodic error analysis,
+// either live or from a recorded session (see ReplayEvents). The guide steps
+// are discarded each time guiding starts, and those made while settling are
+// ignored.
+//
+// PeriodicErrorAnalyzer must receive the client's events through HandleEvent
+// (see DispatchEvents).
+type PeriodicErrorAnalyzer struct {
+	mutex  sync.Mutex
+	config PeriodicErrorConfig
+	settle settleTracker
+	steps  []*GuideStepEvent
+}
+
+// NewPeriodicErrorAnalyzer creates a new PeriodicErrorAnalyzer.
+func NewPeriodicErrorAnalyzer(config PeriodicErrorConfig) *PeriodicErrorAnalyzer {
+	return &PeriodicErrorAnalyzer{
+		config: config,
+	}
+}
+
+// HandleEvent records guide steps.
+func (a *PeriodicErrorAnalyzer) HandleEvent(evt interface{}) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.settle.handleEvent(evt)
+
+	switch e := evt.(type) {
+	case *StartGuidingEvent:
+		a.steps = nil
+	case *GuideStepEvent:
+		if !a.settle.settling {
+			a.steps = append(a.steps, e)
+		}
+	}
+}
+
+// Analyze analyzes the guide steps collected so far.
+func (a *PeriodicErrorAnalyzer) Analyze() PeriodicErrorReport {
+	a.mutex.Lock()
+	steps := a.steps
+	a.mutex.Unlock()
+
+	return AnalyzePeriodicError(steps, a.config)
+}
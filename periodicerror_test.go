@@ -0,0 +1,50 @@
+package phd2_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestPeriodicErrorAnalyzer(t *testing.T) {
+	var recording bytes.Buffer
+	recording.WriteString(`{"jsonrpc":"2.0","result":0,"id":1}` + "\n")
+
+	for i := 0; i < 2400; i++ {
+		// Guide steps are not evenly spaced.
+		tm := float64(i)*2 + 0.3*math.Sin(float64(i))
+		ra := 2*math.Sin(2*math.Pi*tm/480) + 0.5*math.Cos(2*math.Pi*tm/160) + 0.001*tm
+
+		line, err := json.Marshal(&phd2.GuideStepEvent{
+			Event:         phd2.Event{Event: "GuideStep"},
+			Time:          tm,
+			RADistanceRaw: ra,
+		})
+		require.NoError(t, err)
+
+		recording.Write(line)
+		recording.WriteString("\n")
+	}
+
+	a := phd2.NewPeriodicErrorAnalyzer(phd2.PeriodicErrorConfig{PixelScale: 1.5})
+	require.NoError(t, phd2.ReplayEvents(&recording, a))
+
+	report := a.Analyze()
+	assert.Equal(t, 2400, report.Frames)
+	require.True(t, len(report.Components) >= 2)
+
+	assert.InDelta(t, 480, report.Components[0].Period.Seconds(), 1)
+	assert.InDelta(t, 2, report.Components[0].Amplitude, 0.05)
+	assert.InDelta(t, 3, report.Components[0].AmplitudeArcsec, 0.1)
+	assert.InDelta(t, 160, report.Components[1].Period.Seconds(), 1)
+	assert.InDelta(t, 0.5, report.Components[1].Amplitude, 0.05)
+	assert.InDelta(t, 480, report.WormPeriod.Seconds(), 1)
+	assert.Equal(t, time.Duration(0), phd2.AnalyzePeriodicError(nil, phd2.PeriodicErrorConfig{}).WormPeriod)
+}
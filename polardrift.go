@@ -0,0 +1,153 @@
+package phd2
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PolarErrorComponent is the component of the polar alignment error that a
+// Dec drift measurement is sensitive to, which depends on where the star is.
+type PolarErrorComponent string
+
+const (
+	// PolarErrorAzimuth is measured with the star near the meridian.
+	PolarErrorAzimuth = PolarErrorComponent("Azimuth")
+	// PolarErrorAltitude is measured with the star low in the east or west.
+	PolarErrorAltitude = PolarErrorComponent("Altitude")
+)
+
+// PolarDriftConfig configures a PolarDrift measurement.
+type PolarDriftConfig struct {
+	// Duration is how long to measure the drift for.
+	Duration time.Duration
+	// Declination is the guide star's declination in degrees.
+	Declination float64
+	// HourAngle is the guide star's hour angle in hours.
+	HourAngle float64
+	// PixelScale is the pixel scale in arc-sec/pixel. If 0, it is read from
+	// PHD2.
+	PixelScale float64
+}
+
+// PolarDriftResult is the result of a PolarDrift measurement.
+type PolarDriftResult struct {
+	Frames int
+	// DriftRate is the Dec drift in pixels/minute and DriftRateArcsec in
+	// arc-sec/minute.
+	DriftRate       float64
+	DriftRateArcsec float64
+	// FitQuality is the coefficient of determination of the straight line
+	// fitted to the drift, between 0 and 1. Seeing and periodic error lower
+	// it; a low value means the estimate is unreliable.
+	FitQuality float64
+	// Component is the component of the polar alignment error measured.
+	Component PolarErrorComponent
+	// Error is the estimated polar alignment error in arc-minutes.
+	Error float64
+}
+
+// PolarDrift estimates the polar alignment error from the Dec drift of the
+// guide star while guiding in RA only, as in the drift alignment method.
+//
+// PolarDrift must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type PolarDrift struct {
+	c      *RPCClient
+	config PolarDriftConfig
+	queue  *eventQueue
+}
+
+// NewPolarDrift creates a new PolarDrift.
+func NewPolarDrift(c *RPCClient, config PolarDriftConfig) *PolarDrift {
+	return &PolarDrift{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent queues events for measuring.
+func (p *PolarDrift) HandleEvent(evt interface{}) {
+	p.queue.HandleEvent(evt)
+}
+
+// Measure turns Dec guiding off, measures the Dec drift for the configured
+// duration while PHD2 is guiding, and then restores the previous Dec guide
+// mode.
+func (p *PolarDrift) Measure(ctx context.Context) (result PolarDriftResult, err error) {
+	pixelScale := p.config.PixelScale
+	if pixelScale <= 0 {
+		pixelScale, err = p.c.GetPixelScale()
+		if err != nil {
+			return result, errors.Wrap(err, "error getting pixel scale")
+		}
+	}
+
+	mode, err := p.c.GetDecGuideMode()
+	if err != nil {
+		return result, errors.Wrap(err, "error getting Dec guide mode")
+	}
+
+	p.queue.clear()
+
+	err = p.c.SetDecGuideMode(DecGuideModeOff)
+	if err != nil {
+		return result, errors.Wrap(err, "error turning off Dec guiding")
+	}
+
+	defer func() {
+		restoreErr := p.c.SetDecGuideMode(mode)
+		if restoreErr != nil && err == nil {
+			err = errors.Wrap(restoreErr, "error restoring Dec guide mode")
+		}
+	}()
+
+	steps, err := p.queue.collectGuideSteps(ctx, p.config.Duration)
+	if err != nil {
+		return result, errors.Wrap(err, "error measuring drift")
+	}
+
+	if len(steps) < 3 {
+		return result, errors.Errorf("too few guide steps to measure drift: %d", len(steps))
+	}
+
+	minutes := make([]float64, len(steps))
+	dec := make([]float64, len(steps))
+
+	for i, step := range steps {
+		minutes[i] = step.Time / 60
+		dec[i] = step.DecDistanceRaw
+	}
+
+	result.Frames = len(steps)
+	result.DriftRate, _, result.FitQuality = linearFit(minutes, dec)
+	result.DriftRateArcsec = result.DriftRate * pixelScale
+	result.Component, result.Error = polarError(result.DriftRateArcsec, p.config.Declination, p.config.HourAngle)
+
+	return result, nil
+}
+
+// polarError estimates the polar alignment error in arc-minutes from a Dec
+// drift in arc-sec/minute, with the same formula as PHD2's drift alignment
+// tool. Away from the meridian and the horizon the drift mixes both components
+// of the error, and the estimate is of the larger.
+func polarError(driftArcsec, declination, hourAngle float64) (PolarErrorComponent, float64) {
+	// A polar axis misaligned by 1 arc-minute makes the star drift by
+	// 2*pi/1440*60 arc-sec/minute at most.
+	const arcminPerDrift = 1440 / (2 * math.Pi * 60)
+
+	sinHA, cosHA := math.Sincos(hourAngle * math.Pi / 12)
+
+	component := PolarErrorAzimuth
+	factor := math.Abs(cosHA)
+
+	if math.Abs(sinHA) > factor {
+		component = PolarErrorAltitude
+		factor = math.Abs(sinHA)
+	}
+
+	return component, arcminPerDrift * math.Abs(driftArcsec) / (factor * math.Cos(declination*math.Pi/180))
+}
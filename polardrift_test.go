@@ -0,0 +1,62 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestPolarDrift(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	p := phd2.NewPolarDrift(c, phd2.PolarDriftConfig{
+		Duration:    500 * time.Millisecond,
+		Declination: 60,
+		PixelScale:  2,
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, p)
+
+	fake.result("get_dec_guide_mode", "Auto")
+
+	var once sync.Once
+	fake.handle("set_dec_guide_mode", func([]json.RawMessage) (interface{}, error) {
+		once.Do(func() {
+			go func() {
+				// One pixel of drift a minute.
+				for i := 0; i < 10; i++ {
+					fake.emit(&phd2.GuideStepEvent{
+						Event:          phd2.Event{Event: "GuideStep"},
+						Time:           float64(i) * 6,
+						DecDistanceRaw: float64(i) / 10,
+					})
+				}
+			}()
+		})
+		return 0, nil
+	})
+
+	result, err := p.Measure(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 10, result.Frames)
+	assert.InDelta(t, 1, result.DriftRate, 1e-9)
+	assert.InDelta(t, 2, result.DriftRateArcsec, 1e-9)
+	assert.InDelta(t, 1, result.FitQuality, 1e-9)
+	assert.Equal(t, phd2.PolarErrorAzimuth, result.Component)
+	assert.InDelta(t, 15.279, result.Error, 1e-3)
+
+	modes := fake.callsTo("set_dec_guide_mode")
+	require.Len(t, modes, 2)
+	assert.Equal(t, `"Off"`, string(modes[0].Params[0]))
+	assert.Equal(t, `"Auto"`, string(modes[1].Params[0]))
+}
@@ -0,0 +1,298 @@
+package phd2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RigStep is a step of BringUp or TearDown.
+type RigStep string
+
+const (
+	// RigStepSelectProfile finds the profile by name.
+	RigStepSelectProfile = RigStep("SelectProfile")
+	// RigStepStopCapture stops looping or guiding.
+	RigStepStopCapture = RigStep("StopCapture")
+	// RigStepDisconnect disconnects the equipment.
+	RigStepDisconnect = RigStep("Disconnect")
+	// RigStepSetProfile makes the profile current.
+	RigStepSetProfile = RigStep("SetProfile")
+	// RigStepConnect connects the equipment.
+	RigStepConnect = RigStep("Connect")
+	// RigStepVerify checks that the camera and mount are connected.
+	RigStepVerify = RigStep("Verify")
+	// RigStepSetExposure sets the exposure.
+	RigStepSetExposure = RigStep("SetExposure")
+	// RigStepLoop starts looping.
+	RigStepLoop = RigStep("Loop")
+	// RigStepShutdown shuts PHD2 down.
+	RigStepShutdown = RigStep("Shutdown")
+)
+
+// RigStepError is returned by BringUp and TearDown when a step fails.
+type RigStepError struct {
+	Step     RigStep
+	Attempts int
+	Err      error
+}
+
+func (err *RigStepError) Error() string {
+	return fmt.Sprintf("%s failed after %d attempt(s): %v", err.Step, err.Attempts, err.Err)
+}
+
+// Cause returns the error from the last attempt.
+func (err *RigStepError) Cause() error {
+	return err.Err
+}
+
+// RigConfig configures BringUp and TearDown.
+type RigConfig struct {
+	// Profile is the name of the equipment profile to bring up.
+	Profile string
+	// Exposure is the exposure to loop with. If 0 the exposure is left as it
+	// is.
+	Exposure time.Duration
+	// Attempts is how many times a step is tried before giving up, and
+	// RetryDelay how long to wait between tries. They default to 3 and 2s.
+	Attempts   int
+	RetryDelay time.Duration
+	// Shutdown makes TearDown shut PHD2 down once the equipment is
+	// disconnected.
+	Shutdown bool
+
+	// OnStep, if set, is called before each step that has something to do.
+	OnStep func(RigStep)
+}
+
+func (config *RigConfig) setDefaults() {
+	if config.Attempts <= 0 {
+		config.Attempts = 3
+	}
+
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = 2 * time.Second
+	}
+}
+
+// BringUp selects the configured profile, connects its equipment, checks that
+// the camera and mount connected, sets the exposure and starts looping. Steps
+// that are already done are skipped, so calling it again is safe and an
+// already connected rig is not disconnected. If PHD2 is already looping or
+// guiding, it is left to carry on. Errors are *RigStepError.
+func BringUp(ctx context.Context, c *RPCClient, config RigConfig) error {
+	config.setDefaults()
+
+	var profile Profile
+	attempts, err := retryRigStep(ctx, config, func() error {
+		profiles, err := c.GetProfiles()
+		if err != nil {
+			return err
+		}
+
+		for _, p := range profiles {
+			if p.Name == config.Profile {
+				profile = p
+				return nil
+			}
+		}
+
+		return errors.Errorf("no profile named %q", config.Profile)
+	})
+	if err != nil {
+		return &RigStepError{Step: RigStepSelectProfile, Attempts: attempts, Err: err}
+	}
+
+	current, err := c.GetProfile()
+	if err != nil {
+		return &RigStepError{Step: RigStepSelectProfile, Attempts: 1, Err: err}
+	}
+
+	if current.ID != profile.ID {
+		err = disconnectRig(ctx, c, config)
+		if err != nil {
+			return err
+		}
+
+		err = rigStep(ctx, config, RigStepSetProfile, func() error {
+			return c.SetProfile(profile.ID)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	connected, err := c.GetConnected()
+	if err != nil {
+		return &RigStepError{Step: RigStepConnect, Attempts: 1, Err: err}
+	}
+
+	if !connected {
+		err = rigStep(ctx, config, RigStepConnect, func() error {
+			return c.SetConnected(true)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rigStep(ctx, config, RigStepVerify, func() error {
+		equipment, err := c.GetCurrentEquipment()
+		if err != nil {
+			return err
+		}
+
+		return verifyEquipment(equipment)
+	})
+	if err != nil {
+		return err
+	}
+
+	if config.Exposure > 0 {
+		exposure, err := c.GetExposure()
+		if err != nil {
+			return &RigStepError{Step: RigStepSetExposure, Attempts: 1, Err: err}
+		}
+
+		if exposure != config.Exposure {
+			err = rigStep(ctx, config, RigStepSetExposure, func() error {
+				return c.SetExposure(config.Exposure)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	state, err := c.GetAppState()
+	if err != nil {
+		return &RigStepError{Step: RigStepLoop, Attempts: 1, Err: err}
+	}
+
+	if state != AppStateStopped && state != AppStateSelected {
+		return nil
+	}
+
+	return rigStep(ctx, config, RigStepLoop, func() error {
+		err := c.Loop()
+		if err != nil {
+			return err
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		return waitForAppState(waitCtx, c, AppStateLooping, AppStateGuiding, AppStateCalibrating)
+	})
+}
+
+// TearDown stops capturing, disconnects the equipment and, if configured,
+// shuts PHD2 down. Steps that are already done are skipped, so calling it
+// again is safe. Errors are *RigStepError.
+func TearDown(ctx context.Context, c *RPCClient, config RigConfig) error {
+	config.setDefaults()
+
+	err := disconnectRig(ctx, c, config)
+	if err != nil {
+		return err
+	}
+
+	if !config.Shutdown {
+		return nil
+	}
+
+	// PHD2 closes the connection as it shuts down, so it is not retried.
+	config.Attempts = 1
+	return rigStep(ctx, config, RigStepShutdown, c.Shutdown)
+}
+
+// disconnectRig stops capturing and disconnects the equipment, if needed.
+func disconnectRig(ctx context.Context, c *RPCClient, config RigConfig) error {
+	state, err := c.GetAppState()
+	if err != nil {
+		return &RigStepError{Step: RigStepStopCapture, Attempts: 1, Err: err}
+	}
+
+	if state != AppStateStopped {
+		err = rigStep(ctx, config, RigStepStopCapture, func() error {
+			err := c.StopCapture()
+			if err != nil {
+				return err
+			}
+
+			waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+
+			return waitForAppState(waitCtx, c, AppStateStopped)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	connected, err := c.GetConnected()
+	if err != nil {
+		return &RigStepError{Step: RigStepDisconnect, Attempts: 1, Err: err}
+	}
+
+	if !connected {
+		return nil
+	}
+
+	return rigStep(ctx, config, RigStepDisconnect, func() error {
+		return c.SetConnected(false)
+	})
+}
+
+func verifyEquipment(equipment CurrentEquipment) error {
+	for _, e := range []struct {
+		kind string
+		Equipment
+	}{
+		{"camera", equipment.Camera},
+		{"mount", equipment.Mount},
+	} {
+		if e.Name == "" {
+			return errors.Errorf("profile has no %s", e.kind)
+		}
+
+		if !e.Connected {
+			return errors.Errorf("%s %q is not connected", e.kind, e.Name)
+		}
+	}
+
+	return nil
+}
+
+// rigStep runs a step with retries.
+func rigStep(ctx context.Context, config RigConfig, s RigStep, f func() error) error {
+	if config.OnStep != nil {
+		config.OnStep(s)
+	}
+
+	attempts, err := retryRigStep(ctx, config, f)
+	if err != nil {
+		return &RigStepError{Step: s, Attempts: attempts, Err: err}
+	}
+
+	return nil
+}
+
+// retryRigStep calls f until it succeeds or has been tried config.Attempts
+// times, and returns how many times it was tried.
+func retryRigStep(ctx context.Context, config RigConfig, f func() error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= config.Attempts {
+			return attempt, err
+		}
+
+		select {
+		case <-time.After(config.RetryDelay):
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+// fakeRig models the PHD2 state that BringUp and TearDown change.
+type fakeRig struct {
+	mutex     sync.Mutex
+	profile   int
+	connected bool
+	state     phd2.AppState
+	exposure  int
+	// connectFailures is how many more times connecting fails.
+	connectFailures int
+}
+
+func (r *fakeRig) install(fake *fakePHD2) {
+	locked := func(f func(params []json.RawMessage) (interface{}, error)) fakeHandler {
+		return func(params []json.RawMessage) (interface{}, error) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+
+			return f(params)
+		}
+	}
+
+	fake.result("get_profiles", []phd2.Profile{{ID: 1, Name: "Refractor"}, {ID: 2, Name: "Newtonian"}})
+	fake.handle("get_profile", locked(func([]json.RawMessage) (interface{}, error) {
+		return phd2.Profile{ID: r.profile}, nil
+	}))
+	fake.handle("set_profile", locked(func(params []json.RawMessage) (interface{}, error) {
+		if r.connected {
+			return nil, errors.New("cannot change profile while connected")
+		}
+
+		id, err := strconv.Atoi(string(params[0]))
+		r.profile = id
+		return 0, err
+	}))
+	fake.handle("get_connected", locked(func([]json.RawMessage) (interface{}, error) {
+		return r.connected, nil
+	}))
+	fake.handle("set_connected", locked(func(params []json.RawMessage) (interface{}, error) {
+		if r.state != phd2.AppStateStopped {
+			return nil, errors.New("cannot disconnect while capturing")
+		}
+
+		connect := string(params[0]) == "true"
+		if connect && r.connectFailures > 0 {
+			r.connectFailures--
+			return nil, errors.New("mount did not respond")
+		}
+
+		r.connected = connect
+		return 0, nil
+	}))
+	fake.handle("get_current_equipment", locked(func([]json.RawMessage) (interface{}, error) {
+		return phd2.CurrentEquipment{
+			Camera: phd2.Equipment{Name: "Camera", Connected: r.connected},
+			Mount:  phd2.Equipment{Name: "Mount", Connected: r.connected},
+		}, nil
+	}))
+	fake.handle("get_exposure", locked(func([]json.RawMessage) (interface{}, error) {
+		return r.exposure, nil
+	}))
+	fake.handle("set_exposure", locked(func(params []json.RawMessage) (interface{}, error) {
+		exposure, err := strconv.Atoi(string(params[0]))
+		r.exposure = exposure
+		return 0, err
+	}))
+	fake.handle("get_app_state", locked(func([]json.RawMessage) (interface{}, error) {
+		return r.state, nil
+	}))
+	fake.handle("loop", locked(func([]json.RawMessage) (interface{}, error) {
+		r.state = phd2.AppStateLooping
+		return 0, nil
+	}))
+	fake.handle("stop_capture", locked(func([]json.RawMessage) (interface{}, error) {
+		r.state = phd2.AppStateStopped
+		return 0, nil
+	}))
+}
+
+func TestBringUpAndTearDown(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	rig := &fakeRig{
+		profile:         1,
+		connected:       true,
+		state:           phd2.AppStateLooping,
+		exposure:        1000,
+		connectFailures: 1,
+	}
+	rig.install(fake)
+
+	var steps []phd2.RigStep
+	config := phd2.RigConfig{
+		Profile:    "Newtonian",
+		Exposure:   2 * time.Second,
+		RetryDelay: time.Millisecond,
+		Shutdown:   true,
+		OnStep: func(step phd2.RigStep) {
+			steps = append(steps, step)
+		},
+	}
+
+	ctx := context.Background()
+
+	require.NoError(t, phd2.BringUp(ctx, c, config))
+	assert.Equal(t, []phd2.RigStep{
+		phd2.RigStepStopCapture,
+		phd2.RigStepDisconnect,
+		phd2.RigStepSetProfile,
+		phd2.RigStepConnect,
+		phd2.RigStepVerify,
+		phd2.RigStepSetExposure,
+		phd2.RigStepLoop,
+	}, steps)
+	assert.Equal(t, 2, rig.profile)
+	assert.True(t, rig.connected)
+	assert.Equal(t, phd2.AppStateLooping, rig.state)
+	assert.Equal(t, 2000, rig.exposure)
+	assert.Len(t, fake.callsTo("set_connected"), 3, "connecting is retried")
+
+	// Bringing it up again only verifies the equipment.
+	steps = nil
+	require.NoError(t, phd2.BringUp(ctx, c, config))
+	assert.Equal(t, []phd2.RigStep{phd2.RigStepVerify}, steps)
+
+	steps = nil
+	require.NoError(t, phd2.TearDown(ctx, c, config))
+	assert.Equal(t, []phd2.RigStep{
+		phd2.RigStepStopCapture,
+		phd2.RigStepDisconnect,
+		phd2.RigStepShutdown,
+	}, steps)
+	assert.False(t, rig.connected)
+	assert.Equal(t, phd2.AppStateStopped, rig.state)
+	assert.Len(t, fake.callsTo("shutdown"), 1)
+}
+
+func TestBringUpErrors(t *testing.T) {
+	type testCase struct {
+		name            string
+		profile         string
+		connectFailures int
+		step            phd2.RigStep
+		attempts        int
+	}
+
+	testCases := []testCase{
+		{
+			name:     "unknown profile",
+			profile:  "Dobsonian",
+			step:     phd2.RigStepSelectProfile,
+			attempts: 2,
+		},
+		{
+			name:            "connect fails",
+			profile:         "Refractor",
+			connectFailures: 2,
+			step:            phd2.RigStepConnect,
+			attempts:        2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, fake := newFakePHD2(t)
+			defer fake.close()
+
+			rig := &fakeRig{
+				profile:         1,
+				state:           phd2.AppStateStopped,
+				connectFailures: tc.connectFailures,
+			}
+			rig.install(fake)
+
+			err := phd2.BringUp(context.Background(), c, phd2.RigConfig{
+				Profile:    tc.profile,
+				Attempts:   2,
+				RetryDelay: time.Millisecond,
+			})
+
+			var stepErr *phd2.RigStepError
+			require.IsType(t, stepErr, err)
+			stepErr = err.(*phd2.RigStepError)
+			assert.Equal(t, tc.step, stepErr.Step)
+			assert.Equal(t, tc.attempts, stepErr.Attempts)
+			assert.Empty(t, fake.callsTo("loop"))
+		})
+	}
+}
@@ -2,9 +2,13 @@ package phd2
 
 import (
 	"bufio"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"image"
+	"image/color"
+	"math"
 	"net"
 	"sync"
 	"time"
@@ -367,6 +371,16 @@ func (c *RPCClient) FlipCalibration() error {
 	return errors.Wrap(err, "error calling jsonrpc method")
 }
 
+// GetAlgorithmName returns the name of the guide algorithm on an axis.
+func (c *RPCClient) GetAlgorithmName(axis Axis) (string, error) {
+	var result string
+	_, err := c.call("get_algo_param", []interface{}{
+		string(axis),
+		"algorithmName",
+	}, &result)
+	return result, errors.Wrap(err, "error calling jsonrpc method")
+}
+
 // GetAlgorithmParamNames returns an array of guide algorithm param names.
 func (c *RPCClient) GetAlgorithmParamNames(axis Axis) ([]string, error) {
 	var result []string
@@ -458,22 +472,48 @@ func (c *RPCClient) GetExposureDurations() ([]time.Duration, error) {
 	return returnValue, errors.Wrap(err, "error calling jsonrpc method")
 }
 
-// GetLockPosition returns the current lock position, or nil if the lock
-// position is not set.
+// GetGuideOutputEnabled returns true if guide output is enabled, that is if
+// PHD2 sends guide pulses to the mount.
+func (c *RPCClient) GetGuideOutputEnabled() (bool, error) {
+	var result bool
+	_, err := c.call("get_guide_output_enabled", nil, &result)
+	return result, errors.Wrap(err, "error calling jsonrpc method")
+}
+
+// GetLockPosition returns the current lock position rounded to whole pixels,
+// or nil if the lock position is not set. See GetLockPositionF for the exact
+// position.
 func (c *RPCClient) GetLockPosition() (*image.Point, error) {
-	var result []int
-	_, err := c.call("get_lock_position", nil, &result)
+	pos, err := c.GetLockPositionF()
 
 	var pt *image.Point
 
-	if len(result) == 2 {
+	if pos != nil {
 		pt = &image.Point{
+			X: int(math.Round(pos.X)),
+			Y: int(math.Round(pos.Y)),
+		}
+	}
+
+	return pt, err
+}
+
+// GetLockPositionF returns the current lock position, which PHD2 keeps to a
+// fraction of a pixel, or nil if the lock position is not set.
+func (c *RPCClient) GetLockPositionF() (*LockPosition, error) {
+	var result []float64
+	_, err := c.call("get_lock_position", nil, &result)
+
+	var pos *LockPosition
+
+	if len(result) == 2 {
+		pos = &LockPosition{
 			X: result[0],
 			Y: result[1],
 		}
 	}
 
-	return pt, errors.Wrap(err, "error calling jsonrpc method")
+	return pos, errors.Wrap(err, "error calling jsonrpc method")
 }
 
 // GetLockShiftEnabled returns true if lock shift is enabled.
@@ -550,17 +590,36 @@ func (c *RPCClient) GetStarImage(maxSize int) (StarImage, error) {
 		return result, errors.Wrap(err, "error calling jsonrpc method")
 	}
 
+	result.Image, err = decodeStarImagePixels(result.Pixels, result.Width, result.Height)
+	if err != nil {
+		return result, errors.Wrap(err, "error decoding image pixels")
+	}
+
 	return result, nil
-	/*
-		bytes, err := base64.RawStdEncoding.DecodeString(result.Pixels)
+}
+
+// decodeStarImagePixels decodes base64 encoded 16 bit little endian pixels,
+// row by row, into an image.
+func decodeStarImagePixels(pixels string, width, height int) (*image.Gray16, error) {
+	bytes, err := base64.StdEncoding.DecodeString(pixels)
+	if err != nil {
+		bytes, err = base64.RawStdEncoding.DecodeString(pixels)
 		if err != nil {
-			return result, errors.Wrap(err, "error decoding image pixels")
+			return nil, err
 		}
+	}
 
-		// TODO: Turn bytes into an image object.
+	if len(bytes) != 2*width*height {
+		return nil, errors.Errorf("got %d bytes for a %dx%d image", len(bytes), width, height)
+	}
 
-		return result, nil
-	*/
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		v := binary.LittleEndian.Uint16(bytes[2*i:])
+		img.SetGray16(i%width, i/width, color.Gray16{Y: v})
+	}
+
+	return img, nil
 }
 
 // GetUseSubframes returns true if subframes are in use.
@@ -671,6 +730,14 @@ func (c *RPCClient) SetExposure(length time.Duration) error {
 	return errors.Wrap(err, "error calling jsonrpc method")
 }
 
+// SetGuideOutputEnabled enables or disables guide output. With guide output
+// disabled, PHD2 keeps measuring the star but does not move the mount.
+func (c *RPCClient) SetGuideOutputEnabled(enable bool) error {
+	var result int
+	_, err := c.call("set_guide_output_enabled", []interface{}{enable}, &result)
+	return errors.Wrap(err, "error calling jsonrpc method")
+}
+
 // SetLockPosition sets the lock position. When exact is true, the lock
 // position is moved to the exact given coordinates. When false, the current
 // position is moved to the given coordinates and if a guide star is in range,
@@ -781,24 +848,69 @@ type CurrentEquipment struct {
 	Rotator  Equipment `json:"rotator"`
 }
 
-// LockShiftParams represents the current lock shift params.
+// LockShiftParams represents the current lock shift params. Rate holds the
+// rates along the two axes, RA and Dec or X and Y.
 type LockShiftParams struct {
-	Enabled bool      `json:"enabled"`
-	Rate    []float64 `json:"rate"`
-	Units   string    `json:"units"`
-	Axes    string    `json:"axes"`
+	Enabled bool           `json:"enabled"`
+	Rate    []float64      `json:"rate"`
+	Units   LockShiftUnits `json:"units"`
+	Axes    LockShiftAxes  `json:"axes"`
 }
 
+// LockShiftUnits are the units of lock shift rates.
+type LockShiftUnits string
+
+const (
+	// LockShiftUnitsArcsecPerHour is arc-seconds per hour.
+	LockShiftUnitsArcsecPerHour = LockShiftUnits("arcsec/hr")
+	// LockShiftUnitsPixelsPerHour is guide camera pixels per hour.
+	LockShiftUnitsPixelsPerHour = LockShiftUnits("pixels/hr")
+)
+
+// LockShiftAxes are the axes lock shift rates are along.
+type LockShiftAxes string
+
+const (
+	// LockShiftAxesRADec is along RA and Dec.
+	LockShiftAxesRADec = LockShiftAxes("RA/Dec")
+	// LockShiftAxesXY is along the guide camera's X and Y axes.
+	LockShiftAxesXY = LockShiftAxes("X/Y")
+)
+
 // Profile is the id and name of a profile.
 type Profile struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
 }
 
-// StarPosition is a current star position.
+// StarPosition is a current star position in pixels.
 type StarPosition struct {
-	X int `json:"X"`
-	Y int `json:"Y"`
+	X float64
+	Y float64
+}
+
+// UnmarshalJSON decodes the [x, y] array PHD2 sends a star position as.
+func (p *StarPosition) UnmarshalJSON(data []byte) error {
+	var pos []float64
+
+	err := json.Unmarshal(data, &pos)
+	if err != nil {
+		return err
+	}
+
+	if len(pos) != 2 {
+		return errors.Errorf("got %d coordinates for a star position", len(pos))
+	}
+
+	p.X, p.Y = pos[0], pos[1]
+	return nil
+}
+
+// LockPosition is a lock position in pixels. It is returned by
+// GetLockPositionF.
+type LockPosition struct {
+	X float64
+	Y float64
 }
 
 // StarImage is returned by GetStarImage.
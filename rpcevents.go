@@ -10,6 +10,8 @@ func getEvent(name string) (interface{}, bool) { // nolint: gocyclo
 		return &CalibrationCompleteEvent{}, true
 	case "Paused":
 		return &PausedEvent{}, true
+	case "Resumed":
+		return &ResumedEvent{}, true
 	case "AppState":
 		return &AppStateEvent{}, true
 	case "LockPositionSet":
@@ -103,14 +105,14 @@ type LockPositionSetEvent struct {
 // CalibratingEvent is sent on each calibration step.
 type CalibratingEvent struct {
 	Event
-	Mount string `json:"Mount"`
-	Dir   string `json:"dir"`
-	Dist  int    `json:"dist"`
-	DX    int    `json:"dx"`
-	DY    int    `json:"dy"`
-	Pos   []int  `json:"pos"`
-	Step  int    `json:"step"`
-	State string `json:"State"`
+	Mount string    `json:"Mount"`
+	Dir   string    `json:"dir"`
+	Dist  float64   `json:"dist"`
+	DX    float64   `json:"dx"`
+	DY    float64   `json:"dy"`
+	Pos   []float64 `json:"pos"`
+	Step  int       `json:"step"`
+	State string    `json:"State"`
 }
 
 // StarSelectedEvent is sent when a star is selected.
@@ -163,7 +165,7 @@ type SettleBeginEvent struct {
 // until guiding has settled.
 type SettlingEvent struct {
 	Event
-	Distance   int     `json:"Distance"`
+	Distance   float64 `json:"Distance"`
 	Time       float64 `json:"Time"`
 	SettleTime int     `json:"SettleTime"`
 	StarLocked bool    `json:"StarLocked"`
@@ -234,8 +236,8 @@ type GuideStepEvent struct {
 // GuidingDitheredEvent is sent when the lock position has been dithered.
 type GuidingDitheredEvent struct {
 	Event
-	DX int `json:"dx"`
-	DY int `json:"dy"`
+	DX float64 `json:"dx"`
+	DY float64 `json:"dy"`
 }
 
 // LockPositionLostEvent is sent when the lock position has been lost.
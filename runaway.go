@@ -0,0 +1,254 @@
+package phd2
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RunawayReason is why a RunawayDetector decided guiding is running away.
+type RunawayReason string
+
+const (
+	// RunawayMaxPulses means an axis was sent many maximum length pulses in a
+	// row in the same direction.
+	RunawayMaxPulses = RunawayReason("MaxPulses")
+	// RunawayLimited means an axis's corrections were limited by PHD2's
+	// maximum duration many frames in a row.
+	RunawayLimited = RunawayReason("Limited")
+	// RunawayErrorGrowing means the guide error kept growing despite
+	// corrections, as it does when corrections are reversed.
+	RunawayErrorGrowing = RunawayReason("ErrorGrowing")
+)
+
+// RunawayAction is what a RunawayDetector does when guiding runs away.
+type RunawayAction string
+
+const (
+	// RunawayActionStopCapture stops capturing, which stops guiding.
+	RunawayActionStopCapture = RunawayAction("StopCapture")
+	// RunawayActionDisableGuideOutput keeps guiding but stops sending
+	// corrections to the mount, so the star can still be watched.
+	RunawayActionDisableGuideOutput = RunawayAction("DisableGuideOutput")
+	// RunawayActionNone only alerts.
+	RunawayActionNone = RunawayAction("None")
+)
+
+// RunawayAlert describes guiding running away.
+type RunawayAlert struct {
+	Reason RunawayReason
+	// Axis is the axis running away, or "" for RunawayErrorGrowing.
+	Axis Axis
+	// Direction is the direction of the pulses for RunawayMaxPulses.
+	Direction string
+	// Steps is how many guide steps in a row showed the problem.
+	Steps int
+	// Distance is the guide error in pixels at the last step.
+	Distance float64
+	Time     time.Time
+	Action   RunawayAction
+	// Err is set if the action failed.
+	Err error
+}
+
+// RunawayDetectorConfig configures a RunawayDetector.
+type RunawayDetectorConfig struct {
+	// MaxPulse is the maximum pulse duration. Pulses at least this long count
+	// as maximum length as well as those PHD2 reports as limited. If 0 only
+	// limited pulses count.
+	MaxPulse time.Duration
+	// MaxPulses is how many maximum length pulses in a row in the same
+	// direction are a runaway. Defaults to 5.
+	MaxPulses int
+	// LimitedSteps is how many limited corrections in a row on an axis, in
+	// either direction, are a runaway. Defaults to 10.
+	LimitedSteps int
+	// GrowingSteps is how many guide steps in a row the error may grow, with
+	// a correction made each time, before it is a runaway. Defaults to 6.
+	GrowingSteps int
+	// MinDistance is the guide error in pixels below which a growing error is
+	// ignored as seeing. Defaults to 2.
+	MinDistance float64
+	// Action is what to do when guiding runs away. Defaults to
+	// RunawayActionStopCapture.
+	Action RunawayAction
+
+	// OnAlert, if set, is called when guiding runs away. It is called from the
+	// goroutine running Run.
+	OnAlert func(RunawayAlert)
+}
+
+// RunawayDetector watches guide steps for a mount running away, as it does
+// when the guide cable is reversed or the wrong profile is in use, and stops
+// it. Once it has acted, it waits for guiding to be started again.
+//
+// RunawayDetector must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type RunawayDetector struct {
+	c      *RPCClient
+	config RunawayDetectorConfig
+	queue  *eventQueue
+}
+
+// NewRunawayDetector creates a new RunawayDetector.
+func NewRunawayDetector(c *RPCClient, config RunawayDetectorConfig) *RunawayDetector {
+	if config.MaxPulses <= 0 {
+		config.MaxPulses = 5
+	}
+
+	if config.LimitedSteps <= 0 {
+		config.LimitedSteps = 10
+	}
+
+	if config.GrowingSteps <= 0 {
+		config.GrowingSteps = 6
+	}
+
+	if config.MinDistance <= 0 {
+		config.MinDistance = 2
+	}
+
+	if config.Action == "" {
+		config.Action = RunawayActionStopCapture
+	}
+
+	return &RunawayDetector{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent queues events for Run.
+func (d *RunawayDetector) HandleEvent(evt interface{}) {
+	d.queue.HandleEvent(evt)
+}
+
+// runawayAxis tracks the corrections on one axis.
+type runawayAxis struct {
+	axis      Axis
+	direction string
+	maxPulses int
+	limited   int
+}
+
+// step records a correction and returns the reason the axis is running away,
+// if it is.
+func (a *runawayAxis) step(config RunawayDetectorConfig, direction string, duration int, limited bool) RunawayReason {
+	maxPulse := limited || (config.MaxPulse > 0 && time.Duration(duration)*time.Millisecond >= config.MaxPulse)
+
+	switch {
+	case !maxPulse:
+		a.maxPulses = 0
+	case direction == a.direction:
+		a.maxPulses++
+	default:
+		a.maxPulses = 1
+	}
+
+	a.direction = direction
+
+	if limited {
+		a.limited++
+	} else {
+		a.limited = 0
+	}
+
+	switch {
+	case a.maxPulses >= config.MaxPulses:
+		return RunawayMaxPulses
+	case a.limited >= config.LimitedSteps:
+		return RunawayLimited
+	}
+
+	return ""
+}
+
+// Run watches guide steps until the context is done.
+func (d *RunawayDetector) Run(ctx context.Context) error {
+	var ra, dec runawayAxis
+	growing := 0
+	lastDistance := 0.0
+	corrected := false
+	armed := true
+
+	reset := func() {
+		ra = runawayAxis{axis: AxisRA}
+		dec = runawayAxis{axis: AxisDec}
+		growing = 0
+		lastDistance = 0
+		corrected = false
+	}
+	reset()
+
+	return d.queue.waitFor(ctx, func(evt interface{}) (bool, error) {
+		switch e := evt.(type) {
+		case *StartGuidingEvent:
+			reset()
+			armed = true
+		case *GuidingDitheredEvent:
+			// The error jumps when the lock position moves.
+			growing = 0
+			lastDistance = 0
+		case *GuideStepEvent:
+			if !armed {
+				return false, nil
+			}
+
+			distance := math.Hypot(e.RADistanceRaw, e.DecDistanceRaw)
+			if corrected && lastDistance > 0 && distance > lastDistance && distance >= d.config.MinDistance {
+				growing++
+			} else {
+				growing = 0
+			}
+
+			lastDistance = distance
+			corrected = e.RADuration > 0 || e.DecDuration > 0
+
+			alert := RunawayAlert{Distance: distance}
+
+			if reason := ra.step(d.config, e.RADirection, e.RADuration, e.RALimited); reason != "" {
+				alert.Reason, alert.Axis, alert.Direction = reason, AxisRA, ra.direction
+				alert.Steps = ra.maxPulses
+				if reason == RunawayLimited {
+					alert.Steps = ra.limited
+				}
+			} else if reason := dec.step(d.config, e.DecDirection, e.DecDuration, e.DecLimited); reason != "" {
+				alert.Reason, alert.Axis, alert.Direction = reason, AxisDec, dec.direction
+				alert.Steps = dec.maxPulses
+				if reason == RunawayLimited {
+					alert.Steps = dec.limited
+				}
+			} else if growing >= d.config.GrowingSteps {
+				alert.Reason = RunawayErrorGrowing
+				alert.Steps = growing
+			} else {
+				return false, nil
+			}
+
+			armed = false
+			d.act(alert)
+		}
+
+		return false, nil
+	})
+}
+
+// act stops the runaway and sends the alert.
+func (d *RunawayDetector) act(alert RunawayAlert) {
+	alert.Time = time.Now()
+	alert.Action = d.config.Action
+
+	switch d.config.Action {
+	case RunawayActionStopCapture:
+		alert.Err = errors.Wrap(d.c.StopCapture(), "error stopping capture")
+	case RunawayActionDisableGuideOutput:
+		alert.Err = errors.Wrap(d.c.SetGuideOutputEnabled(false), "error disabling guide output")
+	}
+
+	if d.config.OnAlert != nil {
+		d.config.OnAlert(alert)
+	}
+}
@@ -0,0 +1,143 @@
+package phd2_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestRunawayDetector(t *testing.T) {
+	type testCase struct {
+		name   string
+		action phd2.RunawayAction
+		steps  []phd2.GuideStepEvent
+		reason phd2.RunawayReason
+		axis   phd2.Axis
+		method string
+	}
+
+	repeat := func(n int, step phd2.GuideStepEvent) []phd2.GuideStepEvent {
+		var steps []phd2.GuideStepEvent
+		for i := 0; i < n; i++ {
+			steps = append(steps, step)
+		}
+		return steps
+	}
+
+	// growing returns steps whose error grows by a pixel a step despite
+	// corrections.
+	growing := func(n int) []phd2.GuideStepEvent {
+		var steps []phd2.GuideStepEvent
+		for i := 0; i < n; i++ {
+			steps = append(steps, phd2.GuideStepEvent{
+				RADistanceRaw: float64(i + 1),
+				RADuration:    200,
+				RADirection:   "West",
+			})
+		}
+		return steps
+	}
+
+	testCases := []testCase{
+		{
+			name:   "max pulses",
+			steps:  repeat(5, phd2.GuideStepEvent{DecDistanceRaw: 1, DecDuration: 2500, DecDirection: "North"}),
+			reason: phd2.RunawayMaxPulses,
+			axis:   phd2.AxisDec,
+			method: "stop_capture",
+		},
+		{
+			name: "limited",
+			// Never five in a row in the same direction.
+			steps: append(
+				append(
+					repeat(4, phd2.GuideStepEvent{RADistanceRaw: 1, RADuration: 2000, RADirection: "East", RALimited: true}),
+					repeat(4, phd2.GuideStepEvent{RADistanceRaw: 1, RADuration: 2000, RADirection: "West", RALimited: true})...,
+				),
+				repeat(2, phd2.GuideStepEvent{RADistanceRaw: 1, RADuration: 2000, RADirection: "East", RALimited: true})...,
+			),
+			action: phd2.RunawayActionDisableGuideOutput,
+			reason: phd2.RunawayLimited,
+			axis:   phd2.AxisRA,
+			method: "set_guide_output_enabled",
+		},
+		{
+			name:   "error growing",
+			steps:  growing(7),
+			reason: phd2.RunawayErrorGrowing,
+			method: "stop_capture",
+		},
+		{
+			name: "alternating max pulses",
+			steps: append(
+				append(
+					repeat(4, phd2.GuideStepEvent{DecDuration: 2500, DecDirection: "North"}),
+					repeat(4, phd2.GuideStepEvent{DecDuration: 2500, DecDirection: "South"})...,
+				),
+				repeat(4, phd2.GuideStepEvent{DecDuration: 2500, DecDirection: "North"})...,
+			),
+		},
+		{
+			name:  "growing below minimum distance",
+			steps: append(growing(1), repeat(10, phd2.GuideStepEvent{RADistanceRaw: 0.5, RADuration: 100, RADirection: "West"})...),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, fake := newFakePHD2(t)
+			defer fake.close()
+
+			alerts := make(chan phd2.RunawayAlert, 10)
+			d := phd2.NewRunawayDetector(c, phd2.RunawayDetectorConfig{
+				MaxPulse: 2500 * time.Millisecond,
+				Action:   tc.action,
+				OnAlert: func(alert phd2.RunawayAlert) {
+					alerts <- alert
+				},
+			})
+
+			events, err := c.Subscribe()
+			require.NoError(t, err)
+			go phd2.DispatchEvents(events, d)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go d.Run(ctx) // nolint: errcheck
+
+			fake.emit(&phd2.StartGuidingEvent{Event: phd2.Event{Event: "StartGuiding"}})
+			for _, step := range tc.steps {
+				step.Event = phd2.Event{Event: "GuideStep"}
+				fake.emit(&step)
+			}
+
+			if tc.reason == "" {
+				select {
+				case alert := <-alerts:
+					t.Errorf("unexpected alert %+v", alert)
+				case <-time.After(50 * time.Millisecond):
+				}
+				return
+			}
+
+			alert := <-alerts
+			assert.Equal(t, tc.reason, alert.Reason)
+			assert.Equal(t, tc.axis, alert.Axis)
+			assert.NoError(t, alert.Err)
+			assert.Len(t, fake.callsTo(tc.method), 1)
+
+			// Nothing more is alerted until guiding starts again.
+			fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}, DecDuration: 2500, DecDirection: "North"})
+			select {
+			case alert := <-alerts:
+				t.Errorf("unexpected alert %+v", alert)
+			case <-time.After(20 * time.Millisecond):
+			}
+		})
+	}
+}
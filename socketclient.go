@@ -3,6 +3,7 @@ package phd2
 import (
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -76,6 +77,10 @@ type Dialer interface {
 type SocketClient struct {
 	d Dialer
 	c net.Conn
+
+	// Ensures only one command is in flight at a time, since responses carry
+	// nothing to match them to their command.
+	mutex sync.Mutex
 }
 
 // NewSocketClient creates a new client to interface with the PHD2 server.
@@ -87,6 +92,9 @@ func NewSocketClient(d Dialer) *SocketClient {
 
 // Connect will use the Dialer to connect to the PHD2 server.
 func (c *SocketClient) Connect(host string, port int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	var err error
 	c.c, err = c.d.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
 	return errors.Wrap(err, "error connecting to phd2")
@@ -94,6 +102,9 @@ func (c *SocketClient) Connect(host string, port int) error {
 
 // Close will close the underlying client connection.
 func (c *SocketClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return ErrNotConnected
 	}
@@ -105,6 +116,9 @@ func (c *SocketClient) Close() error {
 // Pause pauses guiding. Camera exposures continue to loop if they are already
 // looping.
 func (c *SocketClient) Pause() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return ErrNotConnected
 	}
@@ -129,6 +143,9 @@ func (c *SocketClient) Pause() error {
 
 // Resume resumes guiding if it was paused, otherwise no effect.
 func (c *SocketClient) Resume() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return ErrNotConnected
 	}
@@ -154,6 +171,9 @@ func (c *SocketClient) Resume() error {
 // Stop stops looping exposures or guiding. SocketClient should poll with GetStatus
 // to check that looping/guiding has actually stopped.
 func (c *SocketClient) Stop() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return ErrNotConnected
 	}
@@ -179,6 +199,9 @@ func (c *SocketClient) Stop() error {
 // StartGuiding starts guiding. SocketClient should poll with GetStatus to check that
 // guiding has actually started.
 func (c *SocketClient) StartGuiding() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return ErrNotConnected
 	}
@@ -203,6 +226,9 @@ func (c *SocketClient) StartGuiding() error {
 
 // ClearCalibration clears calibration data (force re-calibration).
 func (c *SocketClient) ClearCalibration() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return ErrNotConnected
 	}
@@ -231,6 +257,9 @@ func (c *SocketClient) ClearCalibration() error {
 // sequence could be used to select a guide star: Stop, Deselect, Loop,
 // LoopFrameCount, AutoFindStar.
 func (c *SocketClient) Deselect() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return ErrNotConnected
 	}
@@ -256,6 +285,9 @@ func (c *SocketClient) Deselect() error {
 // Loop starts looping exposures. SocketClient should poll with GetStatus to see if
 // looping actually started.
 func (c *SocketClient) Loop() (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return false, ErrNotConnected
 	}
@@ -284,6 +316,9 @@ func (c *SocketClient) Loop() (bool, error) {
 
 // GetStatus gets a value describing the state of PHD.
 func (c *SocketClient) GetStatus() (SocketStatus, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return SocketStatusIdle, ErrNotConnected
 	}
@@ -309,6 +344,9 @@ func (c *SocketClient) GetStatus() (SocketStatus, error) {
 // Dither will dither a random amount. Returns the camera exposure time in
 // seconds, but not less than 1.
 func (c *SocketClient) Dither(amt SocketDitherAmount) (uint8, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return 0, ErrNotConnected
 	}
@@ -334,6 +372,9 @@ func (c *SocketClient) Dither(amt SocketDitherAmount) (uint8, error) {
 // RequestDistance requests guide error distance. Returns the current guide
 // error distance in units of 1/100 pixel. Values > 255 are reported as 255.
 func (c *SocketClient) RequestDistance() (uint8, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return 255, ErrNotConnected
 	}
@@ -361,6 +402,9 @@ func (c *SocketClient) RequestDistance() (uint8, error) {
 // 255). The frame counter is incremented for each camera exposure when looping
 // or guiding.
 func (c *SocketClient) LoopFrameCount() (uint8, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return 0, ErrNotConnected
 	}
@@ -385,6 +429,9 @@ func (c *SocketClient) LoopFrameCount() (uint8, error) {
 
 // AutoFindStar auto-selects a guide star.
 func (c *SocketClient) AutoFindStar() (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return false, ErrNotConnected
 	}
@@ -418,6 +465,9 @@ func (c *SocketClient) SetLockPosition(x, y uint16) error {
 
 // FlipRACalibrationData flips the RA calibration data.
 func (c *SocketClient) FlipRACalibrationData() (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.c == nil {
 		return false, ErrNotConnected
 	}
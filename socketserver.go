@@ -0,0 +1,230 @@
+package phd2
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SocketServer accepts connections that speak PHD's legacy single-byte socket
+// protocol and fulfils their commands through an RPCClient. This lets old
+// capture programs be pointed at a gateway rather than directly at PHD2.
+//
+// The loop frame count and guide distance are not available as RPC methods, so
+// the server must receive the client's events through HandleEvent (see
+// DispatchEvents) to answer those commands.
+type SocketServer struct {
+	c      *RPCClient
+	settle Settle
+
+	mutex    sync.Mutex
+	frame    int
+	distance float64
+}
+
+// NewSocketServer creates a new SocketServer. The settle parameters are used
+// when starting guiding or dithering on behalf of a socket client.
+func NewSocketServer(c *RPCClient, settle Settle) *SocketServer {
+	return &SocketServer{
+		c:      c,
+		settle: settle,
+	}
+}
+
+// HandleEvent tracks the frame counter and guide distance from PHD2 events.
+func (s *SocketServer) HandleEvent(evt interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch e := evt.(type) {
+	case *LoopingExposuresEvent:
+		s.frame = e.Frame
+	case *GuideStepEvent:
+		s.frame = e.Frame
+		s.distance = e.AvgDist
+	case *GuidingStoppedEvent:
+		s.distance = 0
+	case *LoopingExposuresStoppedEvent:
+		s.frame = 0
+		s.distance = 0
+	}
+}
+
+// Serve accepts connections on the listener and serves each one on its own
+// goroutine. It returns when the listener fails, e.g. because it was closed.
+func (s *SocketServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return errors.Wrap(err, "error accepting connection")
+		}
+
+		go func() {
+			_ = s.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn serves socket commands from a single connection until it is closed.
+// The connection is closed when ServeConn returns.
+func (s *SocketServer) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	cmd := make([]byte, 1)
+
+	for {
+		_, err := io.ReadFull(conn, cmd)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "error reading command")
+		}
+
+		resp, err := s.command(conn, cmd[0])
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write([]byte{resp})
+		if err != nil {
+			return errors.Wrap(err, "error writing response")
+		}
+	}
+}
+
+// command carries out a single socket command, returning the response byte.
+// Failures of the command are reported to the socket client in the response
+// byte, the same as PHD2 does. Errors with the connection, or failing to get
+// the status from PHD2, are returned and close the connection.
+func (s *SocketServer) command(conn net.Conn, cmd byte) (byte, error) { // nolint: gocyclo
+	switch cmd {
+	case 1: // Pause
+		return zeroOnSuccess(s.c.SetPaused(true, false)), nil
+	case 2: // Resume
+		return zeroOnSuccess(s.c.SetPaused(false, false)), nil
+	case byte(SocketDitherAmountTiny), byte(SocketDitherAmountSmall), byte(SocketDitherAmountNormal),
+		byte(SocketDitherAmountLarge), byte(SocketDitherAmountHuge):
+		return s.dither(SocketDitherAmount(cmd)), nil
+	case 10: // Request distance
+		s.mutex.Lock()
+		distance := s.distance
+		s.mutex.Unlock()
+		return byte(math.Min(math.Round(distance*100), 255)), nil
+	case 14: // Auto find star
+		_, err := s.c.FindStar()
+		return oneOnSuccess(err), nil
+	case 15: // Set lock position
+		var pos [2]uint16
+		err := binary.Read(conn, binary.LittleEndian, &pos)
+		if err != nil {
+			return 0, errors.Wrap(err, "error reading lock position")
+		}
+		return zeroOnSuccess(s.c.SetLockPosition(float64(pos[0]), float64(pos[1]), true)), nil
+	case 16: // Flip RA calibration
+		return oneOnSuccess(s.c.FlipCalibration()), nil
+	case 17: // Get status
+		return s.status()
+	case 18: // Stop
+		return zeroOnSuccess(s.c.StopCapture()), nil
+	case 19: // Loop
+		return zeroOnSuccess(s.c.Loop()), nil
+	case 20: // Start guiding
+		return zeroOnSuccess(s.c.Guide(s.settle, false)), nil
+	case 21: // Loop frame count
+		s.mutex.Lock()
+		frame := s.frame
+		s.mutex.Unlock()
+		if frame > 255 {
+			frame = 255
+		}
+		return byte(frame), nil
+	case 22: // Clear calibration
+		return zeroOnSuccess(s.c.ClearCalibration(MountTypeNone)), nil
+	case 24: // Deselect
+		// The RPC interface has no way to deselect a star, so the command is
+		// answered with PHD2's failure response rather than letting the
+		// client believe guiding stopped using the old star.
+		return 1, nil
+	}
+
+	// Unknown commands are answered with 0, the same as PHD2.
+	return 0, nil
+}
+
+func (s *SocketServer) dither(amt SocketDitherAmount) byte {
+	// Both protocols multiply the amount by the dither scale set in the Brain.
+	err := s.c.Dither(amt.Multiple(), false, s.settle)
+	if err != nil {
+		return 0
+	}
+
+	exposure, err := s.c.GetExposure()
+	if err != nil {
+		return 1
+	}
+
+	seconds := int(math.Ceil(exposure.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	} else if seconds > 255 {
+		seconds = 255
+	}
+
+	return byte(seconds)
+}
+
+// status returns the socket status. An error getting the app state is
+// returned rather than answered, so the socket client sees the connection to
+// PHD2 is broken instead of PHD2 being idle.
+func (s *SocketServer) status() (byte, error) {
+	state, err := s.c.GetAppState()
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting app state")
+	}
+
+	return byte(SocketStatusFromAppState(state)), nil
+}
+
+// SocketStatusFromAppState returns the socket status that corresponds to an RPC
+// app state.
+func SocketStatusFromAppState(state AppState) SocketStatus {
+	switch state {
+	case AppStateSelected:
+		return SocketStatusStarSelected
+	case AppStateCalibrating:
+		return SocketStatusCalibrating
+	case AppStateGuiding:
+		return SocketStatusGuiding
+	case AppStateLostLock:
+		return SocketStatusStarLost
+	case AppStatePaused:
+		return SocketStatusPaused
+	case AppStateLooping:
+		return SocketStatusLooping
+	}
+
+	return SocketStatusIdle
+}
+
+// zeroOnSuccess returns the response for commands that answer 0 on success.
+func zeroOnSuccess(err error) byte {
+	if err != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// oneOnSuccess returns the response for commands that answer 1 on success.
+func oneOnSuccess(err error) byte {
+	if err != nil {
+		return 0
+	}
+
+	return 1
+}
@@ -0,0 +1,89 @@
+package phd2_test
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestSocketServer(t *testing.T) {
+	rpc, fake := newFakePHD2(t)
+	defer fake.close()
+
+	events, err := rpc.Subscribe()
+	require.NoError(t, err)
+
+	server := phd2.NewSocketServer(rpc, phd2.Settle{Pixels: 1.5, TimeSeconds: 10, TimeoutSeconds: 60})
+	go phd2.DispatchEvents(events, server)
+
+	client, serverConn := net.Pipe()
+	go func() {
+		_ = server.ServeConn(serverConn)
+	}()
+
+	c := phd2.NewSocketClient(&pipeDialer{conn: client})
+	require.NoError(t, c.Connect("127.0.0.1", 4300))
+	defer c.Close()
+
+	fake.result("get_app_state", "LostLock")
+	status, err := c.GetStatus()
+	require.NoError(t, err)
+	assert.Equal(t, phd2.SocketStatusStarLost, status)
+
+	fake.result("get_exposure", 2500)
+	seconds, err := c.Dither(phd2.SocketDitherAmountLarge)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(3), seconds)
+
+	dithers := fake.callsTo("dither")
+	require.Len(t, dithers, 1)
+	assert.Equal(t, json.RawMessage("3"), dithers[0].Params[0])
+
+	fake.result("find_star", []float64{100, 200})
+	found, err := c.AutoFindStar()
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	fake.emit(&phd2.GuideStepEvent{
+		Event:   phd2.Event{Event: "GuideStep"},
+		Frame:   7,
+		AvgDist: 0.42,
+	})
+
+	waitUntil(t, func() bool {
+		frame, err := c.LoopFrameCount()
+		return err == nil && frame == 7
+	})
+
+	distance, err := c.RequestDistance()
+	require.NoError(t, err)
+	assert.Equal(t, uint8(42), distance)
+
+	require.NoError(t, c.Pause())
+	require.NoError(t, c.StartGuiding())
+
+	// Deselecting is not supported by the RPC interface.
+	assert.Error(t, c.Deselect())
+
+	assert.Equal(t, []string{
+		"get_app_state",
+		"dither",
+		"get_exposure",
+		"find_star",
+		"set_paused",
+		"guide",
+	}, fake.methods())
+
+	// A broken connection to PHD2 is not reported as idle.
+	fake.handle("get_app_state", func([]json.RawMessage) (interface{}, error) {
+		return nil, errors.New("connection lost")
+	})
+	_, err = c.GetStatus()
+	assert.Error(t, err)
+}
@@ -0,0 +1,236 @@
+package phd2
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SocketWatcher polls a SocketClient and synthesizes events from the changes it
+// observes. The socket protocol has no notifications of its own, so this gives
+// socket-only users an event-driven API similar to RPCClient.Subscribe.
+type SocketWatcher struct {
+	c        *SocketClient
+	interval time.Duration
+}
+
+// NewSocketWatcher creates a new SocketWatcher that polls the client every
+// interval.
+func NewSocketWatcher(c *SocketClient, interval time.Duration) *SocketWatcher {
+	return &SocketWatcher{
+		c:        c,
+		interval: interval,
+	}
+}
+
+// Run polls GetStatus, LoopFrameCount and RequestDistance until the context is
+// done or a poll fails, sending the synthesized events to the events channel.
+// Run does not close the events channel.
+func (w *SocketWatcher) Run(ctx context.Context, events chan<- interface{}) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var previous *socketPoll
+
+	for {
+		current, err := w.poll()
+		if err != nil {
+			return err
+		}
+
+		for _, evt := range socketPollEvents(previous, current) {
+			select {
+			case events <- evt:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		previous = &current
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type socketPoll struct {
+	time     time.Time
+	status   SocketStatus
+	frame    uint8
+	distance uint8
+}
+
+func (w *SocketWatcher) poll() (socketPoll, error) {
+	var p socketPoll
+	var err error
+
+	p.time = time.Now()
+
+	p.status, err = w.c.GetStatus()
+	if err != nil {
+		return p, errors.Wrap(err, "error polling status")
+	}
+
+	p.frame, err = w.c.LoopFrameCount()
+	if err != nil {
+		return p, errors.Wrap(err, "error polling frame count")
+	}
+
+	p.distance, err = w.c.RequestDistance()
+	if err != nil {
+		return p, errors.Wrap(err, "error polling distance")
+	}
+
+	return p, nil
+}
+
+func socketPollEvents(previous *socketPoll, current socketPoll) []interface{} { // nolint: gocyclo
+	if previous == nil {
+		return []interface{}{
+			&SocketInitialStatusEvent{
+				SocketEvent: SocketEvent{
+					Time:     current.time,
+					Previous: current.status,
+					Status:   current.status,
+				},
+			},
+		}
+	}
+
+	evt := SocketEvent{
+		Time:     current.time,
+		Previous: previous.status,
+		Status:   current.status,
+	}
+
+	var events []interface{}
+
+	if current.status != previous.status {
+		events = append(events, &SocketStatusChangedEvent{SocketEvent: evt})
+
+		switch current.status {
+		case SocketStatusIdle:
+			events = append(events, &SocketStoppedEvent{SocketEvent: evt})
+		case SocketStatusLooping:
+			if previous.status == SocketStatusIdle {
+				events = append(events, &SocketLoopingStartedEvent{SocketEvent: evt})
+			}
+		case SocketStatusStarSelected:
+			if previous.status == SocketStatusIdle {
+				events = append(events, &SocketLoopingStartedEvent{SocketEvent: evt})
+			}
+			events = append(events, &SocketStarSelectedEvent{SocketEvent: evt})
+		case SocketStatusCalibrating:
+			events = append(events, &SocketCalibrationStartedEvent{SocketEvent: evt})
+		case SocketStatusGuiding:
+			switch previous.status {
+			case SocketStatusStarLost:
+				events = append(events, &SocketStarRecoveredEvent{SocketEvent: evt})
+			case SocketStatusPaused:
+				events = append(events, &SocketResumedEvent{SocketEvent: evt})
+			default:
+				events = append(events, &SocketGuidingStartedEvent{SocketEvent: evt})
+			}
+		case SocketStatusStarLost:
+			events = append(events, &SocketStarLostEvent{SocketEvent: evt})
+		case SocketStatusPaused:
+			events = append(events, &SocketPausedEvent{SocketEvent: evt})
+		}
+	}
+
+	// Once the counter reaches its cap new frames can no longer be told apart,
+	// so only a change of distance is reported as a frame.
+	saturated := current.frame == 255 && previous.frame == 255
+	if current.frame != 0 && (current.frame != previous.frame || saturated && current.distance != previous.distance) {
+		events = append(events, &SocketFrameEvent{
+			SocketEvent: evt,
+			Frame:       current.frame,
+			Distance:    float64(current.distance) / 100,
+		})
+	}
+
+	return events
+}
+
+// SocketEvent contains the common attributes of all events synthesized by
+// SocketWatcher.
+type SocketEvent struct {
+	// Time is when the poll that produced the event was made.
+	Time time.Time
+	// Previous is the status seen by the previous poll.
+	Previous SocketStatus
+	// Status is the status seen by the current poll.
+	Status SocketStatus
+}
+
+// SocketInitialStatusEvent is sent after the first poll with the status PHD2
+// was in when watching started.
+type SocketInitialStatusEvent struct {
+	SocketEvent
+}
+
+// SocketStatusChangedEvent is sent for every change of status, before any of
+// the more specific transition events.
+type SocketStatusChangedEvent struct {
+	SocketEvent
+}
+
+// SocketStoppedEvent is sent when PHD2 goes idle.
+type SocketStoppedEvent struct {
+	SocketEvent
+}
+
+// SocketLoopingStartedEvent is sent when PHD2 starts looping exposures from
+// idle.
+type SocketLoopingStartedEvent struct {
+	SocketEvent
+}
+
+// SocketStarSelectedEvent is sent when a star becomes selected.
+type SocketStarSelectedEvent struct {
+	SocketEvent
+}
+
+// SocketCalibrationStartedEvent is sent when calibration begins.
+type SocketCalibrationStartedEvent struct {
+	SocketEvent
+}
+
+// SocketGuidingStartedEvent is sent when guiding begins.
+type SocketGuidingStartedEvent struct {
+	SocketEvent
+}
+
+// SocketStarLostEvent is sent when PHD2 loses the guide star while guiding.
+type SocketStarLostEvent struct {
+	SocketEvent
+}
+
+// SocketStarRecoveredEvent is sent when guiding resumes after the star was lost.
+type SocketStarRecoveredEvent struct {
+	SocketEvent
+}
+
+// SocketPausedEvent is sent when PHD2 is paused.
+type SocketPausedEvent struct {
+	SocketEvent
+}
+
+// SocketResumedEvent is sent when guiding resumes after being paused.
+type SocketResumedEvent struct {
+	SocketEvent
+}
+
+// SocketFrameEvent is sent when the loop frame counter changes. The counter is
+// capped at 255 by PHD2; once it is reached, a frame event is only sent when
+// the distance changes, so frames with the same distance are missed.
+type SocketFrameEvent struct {
+	SocketEvent
+	Frame uint8
+	// Distance is the guide error distance in pixels, capped at 2.55.
+	Distance float64
+}
@@ -0,0 +1,151 @@
+package phd2_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+// fakeSocketPHD2 answers the polling commands of the socket protocol from its
+// current state.
+type fakeSocketPHD2 struct {
+	mutex    sync.Mutex
+	status   phd2.SocketStatus
+	frame    uint8
+	distance uint8
+	commands []byte
+}
+
+// received returns the commands other than polls that have been received.
+func (f *fakeSocketPHD2) received() []byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]byte(nil), f.commands...)
+}
+
+func (f *fakeSocketPHD2) set(status phd2.SocketStatus, frame, distance uint8) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.status = status
+	f.frame = frame
+	f.distance = distance
+}
+
+func (f *fakeSocketPHD2) serve(conn net.Conn) {
+	cmd := make([]byte, 1)
+
+	for {
+		_, err := conn.Read(cmd)
+		if err != nil {
+			return
+		}
+
+		f.mutex.Lock()
+		var resp byte
+		switch cmd[0] {
+		case 17:
+			resp = byte(f.status)
+		case 21:
+			resp = f.frame
+		case 10:
+			resp = f.distance
+		default:
+			f.commands = append(f.commands, cmd[0])
+		}
+		f.mutex.Unlock()
+
+		_, err = conn.Write([]byte{resp})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestSocketWatcher(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	fake := &fakeSocketPHD2{}
+	go fake.serve(server)
+
+	c := phd2.NewSocketClient(&pipeDialer{conn: client})
+	require.NoError(t, c.Connect("127.0.0.1", 4300))
+
+	w := phd2.NewSocketWatcher(c, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan interface{})
+	done := make(chan error, 1)
+
+	go func() {
+		done <- w.Run(ctx, events)
+	}()
+
+	next := func() interface{} {
+		select {
+		case evt := <-events:
+			return evt
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return nil
+	}
+
+	initial, ok := next().(*phd2.SocketInitialStatusEvent)
+	require.True(t, ok)
+	assert.Equal(t, phd2.SocketStatusIdle, initial.Status)
+
+	fake.set(phd2.SocketStatusLooping, 0, 0)
+	assert.IsType(t, &phd2.SocketStatusChangedEvent{}, next())
+	assert.IsType(t, &phd2.SocketLoopingStartedEvent{}, next())
+
+	fake.set(phd2.SocketStatusGuiding, 1, 42)
+	assert.IsType(t, &phd2.SocketStatusChangedEvent{}, next())
+	assert.IsType(t, &phd2.SocketGuidingStartedEvent{}, next())
+
+	frame, ok := next().(*phd2.SocketFrameEvent)
+	require.True(t, ok)
+	assert.Equal(t, uint8(1), frame.Frame)
+	assert.InDelta(t, 0.42, frame.Distance, 1e-9)
+
+	fake.set(phd2.SocketStatusStarLost, 1, 42)
+	assert.IsType(t, &phd2.SocketStatusChangedEvent{}, next())
+	lost, ok := next().(*phd2.SocketStarLostEvent)
+	require.True(t, ok)
+	assert.Equal(t, phd2.SocketStatusGuiding, lost.Previous)
+
+	fake.set(phd2.SocketStatusGuiding, 1, 42)
+	assert.IsType(t, &phd2.SocketStatusChangedEvent{}, next())
+	assert.IsType(t, &phd2.SocketStarRecoveredEvent{}, next())
+
+	// Once the counter is saturated only distance changes are frames.
+	fake.set(phd2.SocketStatusGuiding, 255, 42)
+	frame, ok = next().(*phd2.SocketFrameEvent)
+	require.True(t, ok)
+	assert.Equal(t, uint8(255), frame.Frame)
+
+	select {
+	case evt := <-events:
+		t.Fatalf("unexpected event %T", evt)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	fake.set(phd2.SocketStatusGuiding, 255, 50)
+	frame, ok = next().(*phd2.SocketFrameEvent)
+	require.True(t, ok)
+	assert.InDelta(t, 0.5, frame.Distance, 1e-9)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
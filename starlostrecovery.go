@@ -0,0 +1,265 @@
+package phd2
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RecoveryStep is a step taken by StarLostRecovery.
+type RecoveryStep string
+
+const (
+	// RecoveryStepWaiting means the star was lost and PHD2 is given a grace
+	// period to find it again on its own.
+	RecoveryStepWaiting = RecoveryStep("Waiting")
+	// RecoveryStepFindStar means a star is being selected and the lock
+	// position moved back to where it was before the star was lost.
+	RecoveryStepFindStar = RecoveryStep("FindStar")
+	// RecoveryStepGuide means guiding is being restarted from looping.
+	RecoveryStepGuide = RecoveryStep("Guide")
+	// RecoveryStepRecovered means guiding resumed.
+	RecoveryStepRecovered = RecoveryStep("Recovered")
+	// RecoveryStepGaveUp means every attempt failed. Recovery is not tried
+	// again until guiding resumes by other means.
+	RecoveryStepGaveUp = RecoveryStep("GaveUp")
+	// RecoveryStepAborted means guiding was stopped during recovery.
+	RecoveryStepAborted = RecoveryStep("Aborted")
+)
+
+// RecoveryReport describes a step taken by StarLostRecovery.
+type RecoveryReport struct {
+	Step RecoveryStep
+	// Attempt counts the escalations past waiting, starting at 1. It is 0 for
+	// the initial wait.
+	Attempt int
+	Time    time.Time
+	// Err is the error from the previous step, if it failed.
+	Err error
+}
+
+// StarLostRecoveryConfig configures a StarLostRecovery.
+type StarLostRecoveryConfig struct {
+	// GracePeriod is how long PHD2 is given to find the star on its own.
+	GracePeriod time.Duration
+	// FindStarWait is how long to wait for guiding to resume after a star was
+	// selected and the lock position restored.
+	FindStarWait time.Duration
+	// Settle is used when restarting guiding.
+	Settle Settle
+	// MaxAttempts is how many times to escalate through finding a star and
+	// restarting guiding before giving up. Defaults to 1.
+	MaxAttempts int
+
+	// OnStep, if set, is called for every step taken. It is called from the
+	// goroutine running Run.
+	OnStep func(RecoveryReport)
+}
+
+// StarLostRecovery watches for the guide star being lost while guiding, and
+// when PHD2 does not find it again on its own, escalates from waiting, to
+// selecting a star and restoring the old lock position, to restarting guiding
+// and waiting for it to settle.
+//
+// StarLostRecovery must receive the client's events through HandleEvent (see
+// DispatchEvents).
+type StarLostRecovery struct {
+	c      *RPCClient
+	config StarLostRecoveryConfig
+	queue  *eventQueue
+
+	mutex sync.Mutex
+	lock  *LockPositionSetEvent
+}
+
+// NewStarLostRecovery creates a new StarLostRecovery.
+func NewStarLostRecovery(c *RPCClient, config StarLostRecoveryConfig) *StarLostRecovery {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 1
+	}
+
+	return &StarLostRecovery{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent remembers the lock position and queues events for Run.
+func (r *StarLostRecovery) HandleEvent(evt interface{}) {
+	if e, ok := evt.(*LockPositionSetEvent); ok {
+		r.mutex.Lock()
+		r.lock = e
+		r.mutex.Unlock()
+	}
+
+	r.queue.HandleEvent(evt)
+}
+
+// errGuidingStopped is used internally to abort recovery when guiding stops.
+var errGuidingStopped = errors.New("guiding stopped")
+
+// Run watches for the star being lost and recovers from it until the context
+// is done.
+func (r *StarLostRecovery) Run(ctx context.Context) error {
+	armed := true
+
+	for {
+		var lost bool
+
+		err := r.queue.waitFor(ctx, func(evt interface{}) (bool, error) {
+			switch evt.(type) {
+			case *StarLostEvent:
+				lost = armed
+				return lost, nil
+			case *GuideStepEvent, *StartGuidingEvent:
+				armed = true
+			}
+
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if !lost {
+			continue
+		}
+
+		err = r.recover(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		switch errors.Cause(err) {
+		case nil:
+			r.report(RecoveryStepRecovered, 0, nil)
+		case errGuidingStopped:
+			r.report(RecoveryStepAborted, 0, nil)
+		default:
+			r.report(RecoveryStepGaveUp, r.config.MaxAttempts, err)
+			armed = false
+		}
+	}
+}
+
+func (r *StarLostRecovery) report(step RecoveryStep, attempt int, err error) {
+	if r.config.OnStep != nil {
+		r.config.OnStep(RecoveryReport{
+			Step:    step,
+			Attempt: attempt,
+			Time:    time.Now(),
+			Err:     err,
+		})
+	}
+}
+
+func (r *StarLostRecovery) recover(ctx context.Context) error {
+	r.report(RecoveryStepWaiting, 0, nil)
+
+	lockX, lockY, err := r.lockPosition()
+	if err != nil {
+		return err
+	}
+
+	err = r.waitForGuiding(ctx, r.config.GracePeriod)
+	if err != ErrTimeout {
+		return err
+	}
+
+	for attempt := 1; attempt <= r.config.MaxAttempts; attempt++ {
+		r.report(RecoveryStepFindStar, attempt, err)
+
+		err = r.findStar(ctx, lockX, lockY)
+		if err == nil || err == errGuidingStopped || ctx.Err() != nil {
+			return err
+		}
+
+		r.report(RecoveryStepGuide, attempt, err)
+
+		err = r.guide(ctx)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// lockPosition returns the last lock position set, asking PHD2 if none has
+// been seen.
+func (r *StarLostRecovery) lockPosition() (float64, float64, error) {
+	r.mutex.Lock()
+	lock := r.lock
+	r.mutex.Unlock()
+
+	if lock != nil {
+		return lock.X, lock.Y, nil
+	}
+
+	pos, err := r.c.GetLockPositionF()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if pos == nil {
+		return 0, 0, errors.New("no lock position to recover")
+	}
+
+	return pos.X, pos.Y, nil
+}
+
+// waitForGuiding waits for a guide step, which PHD2 only sends when it has the
+// star. It returns ErrTimeout if none arrives in time.
+func (r *StarLostRecovery) waitForGuiding(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := r.queue.waitFor(ctx, func(evt interface{}) (bool, error) {
+		switch evt.(type) {
+		case *GuideStepEvent:
+			return true, nil
+		case *GuidingStoppedEvent:
+			return true, errGuidingStopped
+		}
+
+		return false, nil
+	})
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+
+	return err
+}
+
+func (r *StarLostRecovery) findStar(ctx context.Context, lockX, lockY float64) error {
+	_, err := r.c.FindStar()
+	if err != nil {
+		return err
+	}
+
+	err = r.c.SetLockPosition(lockX, lockY, true)
+	if err != nil {
+		return err
+	}
+
+	return r.waitForGuiding(ctx, r.config.FindStarWait)
+}
+
+func (r *StarLostRecovery) guide(ctx context.Context) error {
+	err := r.c.Loop()
+	if err != nil {
+		return err
+	}
+
+	r.queue.clear()
+
+	err = r.c.Guide(r.config.Settle, false)
+	if err != nil {
+		return err
+	}
+
+	return r.queue.waitForSettle(ctx)
+}
@@ -0,0 +1,115 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func nextRecoveryStep(t *testing.T, steps <-chan phd2.RecoveryReport) phd2.RecoveryStep {
+	select {
+	case report := <-steps:
+		return report.Step
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for recovery step")
+	}
+	return ""
+}
+
+func TestGetLockPosition(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	fake.result("get_lock_position", []float64{512.5, 384.25})
+
+	pos, err := c.GetLockPositionF()
+	require.NoError(t, err)
+	require.NotNil(t, pos)
+	assert.Equal(t, phd2.LockPosition{X: 512.5, Y: 384.25}, *pos)
+
+	pt, err := c.GetLockPosition()
+	require.NoError(t, err)
+	require.NotNil(t, pt)
+	assert.Equal(t, image.Pt(513, 384), *pt)
+
+	fake.result("get_lock_position", nil)
+
+	pos, err = c.GetLockPositionF()
+	require.NoError(t, err)
+	assert.Nil(t, pos)
+}
+
+func TestStarLostRecovery(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	steps := make(chan phd2.RecoveryReport, 10)
+
+	r := phd2.NewStarLostRecovery(c, phd2.StarLostRecoveryConfig{
+		GracePeriod:  10 * time.Millisecond,
+		FindStarWait: 10 * time.Millisecond,
+		OnStep: func(report phd2.RecoveryReport) {
+			steps <- report
+		},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = r.Run(ctx)
+	}()
+
+	fake.emit(&phd2.LockPositionSetEvent{Event: phd2.Event{Event: "LockPositionSet"}, X: 512.5, Y: 384.25})
+
+	fake.result("find_star", []float64{500, 380})
+	fake.handle("set_lock_position", func([]json.RawMessage) (interface{}, error) {
+		go fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}})
+		return 0, nil
+	})
+
+	fake.emit(&phd2.StarLostEvent{Event: phd2.Event{Event: "StarLost"}})
+
+	assert.Equal(t, phd2.RecoveryStepWaiting, nextRecoveryStep(t, steps))
+	assert.Equal(t, phd2.RecoveryStepFindStar, nextRecoveryStep(t, steps))
+	assert.Equal(t, phd2.RecoveryStepRecovered, nextRecoveryStep(t, steps))
+
+	locks := fake.callsTo("set_lock_position")
+	require.Len(t, locks, 1)
+	assert.Equal(t, "512.5", string(locks[0].Params[0]))
+	assert.Equal(t, "384.25", string(locks[0].Params[1]))
+	assert.Equal(t, "true", string(locks[0].Params[2]))
+
+	fake.handle("find_star", func([]json.RawMessage) (interface{}, error) {
+		return nil, errors.New("no star found")
+	})
+	fake.handle("guide", func([]json.RawMessage) (interface{}, error) {
+		go fake.emit(&phd2.SettleDoneEvent{Event: phd2.Event{Event: "SettleDone"}, Status: 1, Error: "timed out"})
+		return 0, nil
+	})
+
+	fake.emit(&phd2.StarLostEvent{Event: phd2.Event{Event: "StarLost"}})
+
+	assert.Equal(t, phd2.RecoveryStepWaiting, nextRecoveryStep(t, steps))
+	assert.Equal(t, phd2.RecoveryStepFindStar, nextRecoveryStep(t, steps))
+	assert.Equal(t, phd2.RecoveryStepGuide, nextRecoveryStep(t, steps))
+	assert.Equal(t, phd2.RecoveryStepGaveUp, nextRecoveryStep(t, steps))
+
+	// Having given up, further losses are ignored until guiding resumes.
+	fake.emit(&phd2.StarLostEvent{Event: phd2.Event{Event: "StarLost"}})
+	fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}})
+	fake.emit(&phd2.StarLostEvent{Event: phd2.Event{Event: "StarLost"}})
+	assert.Equal(t, phd2.RecoveryStepWaiting, nextRecoveryStep(t, steps))
+}
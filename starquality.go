@@ -0,0 +1,428 @@
+package phd2
+
+import (
+	"context"
+	"image"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StarQualityProblem is a way the guide star has degraded.
+type StarQualityProblem string
+
+const (
+	// StarQualityLowSNR means the star's SNR is below the minimum.
+	StarQualityLowSNR = StarQualityProblem("LowSNR")
+	// StarQualityFading means the star mass has dropped well below what it
+	// was when guiding started.
+	StarQualityFading = StarQualityProblem("Fading")
+	// StarQualitySaturated means the star's peak is saturated.
+	StarQualitySaturated = StarQualityProblem("Saturated")
+)
+
+// StarQualityReport describes the quality of the guide star.
+type StarQualityReport struct {
+	Problem StarQualityProblem
+	// SNR and StarMass are the recent averages, and BaselineStarMass the
+	// average when guiding started.
+	SNR              float64
+	StarMass         float64
+	BaselineStarMass float64
+	// Peak is the peak pixel value in the last star image checked.
+	Peak uint16
+	Time time.Time
+}
+
+// StarReselection describes a new guide star selected by Reselect.
+type StarReselection struct {
+	// Before is the report that caused the reselection.
+	Before StarQualityReport
+	// Position is the position of the new star.
+	Position image.Point
+	// Peak is the peak pixel value of the new star.
+	Peak uint16
+}
+
+// StarQualityWatchdogConfig configures a StarQualityWatchdog.
+type StarQualityWatchdogConfig struct {
+	// Frames is how many guide steps SNR and star mass are averaged over
+	// before being compared to the thresholds, so a problem must last that
+	// long. Defaults to 10.
+	Frames int
+	// BaselineFrames is how many guide steps after guiding starts the
+	// baseline star mass is averaged over. Defaults to 20.
+	BaselineFrames int
+	// MinSNR is the lowest acceptable SNR. Defaults to 10.
+	MinSNR float64
+	// Fading is the fraction of the baseline star mass below which the star
+	// is fading. Defaults to 0.5.
+	Fading float64
+	// CameraBits is the bit depth of the guide camera. PHD2 does not scale
+	// star images to 16 bits, so an 8, 12 or 14 bit camera saturates at a
+	// much lower pixel value. Defaults to 16.
+	CameraBits int
+	// MaxPeak is the peak pixel value at which the star is saturated.
+	// Defaults to 99% of the largest value at CameraBits.
+	MaxPeak uint16
+	// SaturatedImages is how many star images checked in a row must be
+	// saturated before the star is. Defaults to 2.
+	SaturatedImages int
+	// ImageInterval is how often the star image is checked while guiding.
+	// Defaults to a minute.
+	ImageInterval time.Duration
+	// LoopFrames is how many frames are taken before selecting a new star.
+	// Defaults to 3.
+	LoopFrames int
+	// Settle is used when guiding is restarted on the new star.
+	Settle Settle
+
+	// OnDegraded, if set, is called when the star degrades. It is called from
+	// the goroutine running Run.
+	OnDegraded func(StarQualityReport)
+	// OnRecovered, if set, is called with the report of the problem when a
+	// degraded star recovers. It is called from the goroutine running Run.
+	OnRecovered func(StarQualityReport)
+	// OnImageError, if set, is called when the star image cannot be checked.
+	// The star may have been lost, so Run carries on and the image is checked
+	// again at the next interval. It is called from the goroutine running
+	// Run.
+	OnImageError func(error)
+}
+
+// StarQualityWatchdog tracks the guide star's SNR and star mass, and checks
+// its image for saturation. When the star has degraded, Reselect selects a new
+// one; it is up to the caller to call it between imaging exposures, as guiding
+// stops while the star is changed. A star that recovers, for example after a
+// passing cloud, is no longer degraded.
+//
+// StarQualityWatchdog must receive the client's events through HandleEvent
+// (see DispatchEvents).
+type StarQualityWatchdog struct {
+	c        *RPCClient
+	config   StarQualityWatchdogConfig
+	queue    *eventQueue
+	requests chan reselectRequest
+
+	guiding   bool
+	settling  bool
+	frames    int
+	baseline  float64
+	snr       []float64
+	mass      []float64
+	peak      uint16
+	saturated int
+	degraded  *StarQualityReport
+}
+
+type reselectRequest struct {
+	ctx   context.Context
+	reply chan reselectResult
+}
+
+type reselectResult struct {
+	reselection *StarReselection
+	err         error
+}
+
+// NewStarQualityWatchdog creates a new StarQualityWatchdog.
+func NewStarQualityWatchdog(c *RPCClient, config StarQualityWatchdogConfig) *StarQualityWatchdog {
+	if config.Frames <= 0 {
+		config.Frames = 10
+	}
+
+	if config.BaselineFrames <= 0 {
+		config.BaselineFrames = 20
+	}
+
+	if config.MinSNR <= 0 {
+		config.MinSNR = 10
+	}
+
+	if config.Fading <= 0 {
+		config.Fading = 0.5
+	}
+
+	if config.CameraBits <= 0 || config.CameraBits > 16 {
+		config.CameraBits = 16
+	}
+
+	if config.MaxPeak == 0 {
+		config.MaxPeak = uint16(0.99 * float64(uint32(1)<<uint(config.CameraBits)-1))
+	}
+
+	if config.SaturatedImages <= 0 {
+		config.SaturatedImages = 2
+	}
+
+	if config.ImageInterval <= 0 {
+		config.ImageInterval = time.Minute
+	}
+
+	if config.LoopFrames <= 0 {
+		config.LoopFrames = 3
+	}
+
+	return &StarQualityWatchdog{
+		c:        c,
+		config:   config,
+		queue:    newEventQueue(),
+		requests: make(chan reselectRequest),
+	}
+}
+
+// HandleEvent queues events for Run.
+func (w *StarQualityWatchdog) HandleEvent(evt interface{}) {
+	w.queue.HandleEvent(evt)
+}
+
+// Run watches the guide star until the context is done.
+func (w *StarQualityWatchdog) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.config.ImageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case evt := <-w.queue.events:
+			w.handleEvent(evt)
+		case <-ticker.C:
+			if w.guiding && !w.settling {
+				w.checkImage()
+			}
+		case req := <-w.requests:
+			reselection, err := w.reselect(req.ctx)
+			req.reply <- reselectResult{reselection: reselection, err: err}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Reselect selects a new guide star if the current one has degraded, and
+// returns nil if it has not or has since recovered. The new star is checked
+// not to be saturated before guiding on it; if it fails, PHD2 is left looping
+// rather than guiding on a bad star. Run must be running.
+func (w *StarQualityWatchdog) Reselect(ctx context.Context) (*StarReselection, error) {
+	req := reselectRequest{
+		ctx:   ctx,
+		reply: make(chan reselectResult, 1),
+	}
+
+	select {
+	case w.requests <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	result := <-req.reply
+	return result.reselection, result.err
+}
+
+func (w *StarQualityWatchdog) reset() {
+	w.settling = false
+	w.frames = 0
+	w.baseline = 0
+	w.snr, w.mass = nil, nil
+	w.peak = 0
+	w.saturated = 0
+	w.degraded = nil
+}
+
+func (w *StarQualityWatchdog) handleEvent(evt interface{}) {
+	switch e := evt.(type) {
+	case *StartGuidingEvent:
+		w.reset()
+		w.guiding = true
+	case *GuidingStoppedEvent:
+		w.guiding = false
+	case *SettleBeginEvent, *GuidingDitheredEvent:
+		w.settling = true
+	case *SettleDoneEvent:
+		w.settling = false
+	case *GuideStepEvent:
+		if w.settling || e.StarMass <= 0 {
+			return
+		}
+
+		if w.frames < w.config.BaselineFrames {
+			w.frames++
+			w.baseline += (e.StarMass - w.baseline) / float64(w.frames)
+		}
+
+		w.snr = append(w.snr, e.SNR)
+		w.mass = append(w.mass, e.StarMass)
+
+		if len(w.snr) > w.config.Frames {
+			w.snr = w.snr[1:]
+			w.mass = w.mass[1:]
+		}
+
+		if len(w.snr) < w.config.Frames {
+			return
+		}
+
+		w.check()
+	}
+}
+
+// problem returns how the star has degraded, or "" if SNR, star mass and the
+// peak are all within their thresholds.
+func (w *StarQualityWatchdog) problem() StarQualityProblem {
+	if len(w.snr) >= w.config.Frames {
+		switch {
+		case mean(w.snr) < w.config.MinSNR:
+			return StarQualityLowSNR
+		case w.frames >= w.config.BaselineFrames && mean(w.mass) < w.config.Fading*w.baseline:
+			return StarQualityFading
+		}
+	}
+
+	if w.saturated >= w.config.SaturatedImages {
+		return StarQualitySaturated
+	}
+
+	return ""
+}
+
+// check records a problem with the star, or that it has recovered.
+func (w *StarQualityWatchdog) check() {
+	problem := w.problem()
+	if problem != "" {
+		w.degrade(problem)
+		return
+	}
+
+	if w.degraded == nil {
+		return
+	}
+
+	report := *w.degraded
+	w.degraded = nil
+
+	if w.config.OnRecovered != nil {
+		w.config.OnRecovered(report)
+	}
+}
+
+// checkImage checks the star image for saturation. Errors are passed to
+// OnImageError rather than stopping Run, as the star may have been lost, and
+// the image is checked again later.
+func (w *StarQualityWatchdog) checkImage() {
+	img, err := w.c.GetStarImage(0)
+	if err != nil {
+		if w.config.OnImageError != nil {
+			w.config.OnImageError(errors.Wrap(err, "error getting star image"))
+		}
+		return
+	}
+
+	w.peak = starImagePeak(img)
+
+	if w.peak < w.config.MaxPeak {
+		w.saturated = 0
+	} else {
+		w.saturated++
+	}
+
+	w.check()
+}
+
+// degrade records a problem, which is reported if the star was not already
+// degraded.
+func (w *StarQualityWatchdog) degrade(problem StarQualityProblem) {
+	if w.degraded != nil {
+		return
+	}
+
+	w.degraded = &StarQualityReport{
+		Problem:          problem,
+		SNR:              mean(w.snr),
+		StarMass:         mean(w.mass),
+		BaselineStarMass: w.baseline,
+		Peak:             w.peak,
+		Time:             time.Now(),
+	}
+
+	if w.config.OnDegraded != nil {
+		w.config.OnDegraded(*w.degraded)
+	}
+}
+
+// reselect stops guiding, selects and verifies a new star, and guides on it.
+func (w *StarQualityWatchdog) reselect(ctx context.Context) (*StarReselection, error) {
+	if w.degraded == nil {
+		return nil, nil
+	}
+
+	reselection := &StarReselection{Before: *w.degraded}
+
+	w.queue.clear()
+
+	err := w.c.Loop()
+	if err != nil {
+		return nil, errors.Wrap(err, "error stopping guiding")
+	}
+
+	w.guiding = false
+
+	err = w.queue.waitForFrames(ctx, w.config.LoopFrames)
+	if err != nil {
+		return nil, errors.Wrap(err, "error waiting for frames")
+	}
+
+	pos, err := w.c.FindStar()
+	if err != nil {
+		return nil, errors.Wrap(err, "error finding star")
+	}
+
+	if len(pos) >= 2 {
+		reselection.Position = image.Pt(int(pos[0]+0.5), int(pos[1]+0.5))
+	}
+
+	img, err := w.c.GetStarImage(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting star image")
+	}
+
+	reselection.Peak = starImagePeak(img)
+	if reselection.Peak >= w.config.MaxPeak {
+		return nil, errors.Errorf("new star is saturated, peak %d", reselection.Peak)
+	}
+
+	w.queue.clear()
+
+	err = w.c.Guide(w.config.Settle, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "error starting guiding")
+	}
+
+	err = w.queue.waitForSettle(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error waiting for settling")
+	}
+
+	// The StartGuiding event was consumed while settling.
+	w.reset()
+	w.guiding = true
+
+	return reselection, nil
+}
+
+// starImagePeak returns the peak pixel value of a star image.
+func starImagePeak(img StarImage) uint16 {
+	gray, ok := img.Image.(*image.Gray16)
+	if !ok {
+		return 0
+	}
+
+	var peak uint16
+	for y := gray.Rect.Min.Y; y < gray.Rect.Max.Y; y++ {
+		for x := gray.Rect.Min.X; x < gray.Rect.Max.X; x++ {
+			if v := gray.Gray16At(x, y).Y; v > peak {
+				peak = v
+			}
+		}
+	}
+
+	return peak
+}
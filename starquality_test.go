@@ -0,0 +1,230 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+// starImage returns a get_star_image result for a 4x4 image with a star of the
+// given peak in the middle.
+func starImage(peak uint16) map[string]interface{} {
+	bytes := make([]byte, 2*4*4)
+	for i := 0; i < 16; i++ {
+		binary.LittleEndian.PutUint16(bytes[2*i:], 1000)
+	}
+	binary.LittleEndian.PutUint16(bytes[2*(2*4+1):], peak)
+
+	return map[string]interface{}{
+		"frame":    1,
+		"width":    4,
+		"height":   4,
+		"star_pos": []float64{1.2, 2.3},
+		"pixels":   base64.StdEncoding.EncodeToString(bytes),
+	}
+}
+
+func TestGetStarImage(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	fake.result("get_star_image", starImage(30000))
+
+	img, err := c.GetStarImage(0)
+	require.NoError(t, err)
+	assert.Equal(t, phd2.StarPosition{X: 1.2, Y: 2.3}, img.StarPos)
+	require.NotNil(t, img.Image)
+	assert.Equal(t, 4, img.Image.Bounds().Dx())
+
+	r, _, _, _ := img.Image.At(1, 2).RGBA()
+	assert.Equal(t, uint32(30000), r)
+	r, _, _, _ = img.Image.At(0, 0).RGBA()
+	assert.Equal(t, uint32(1000), r)
+}
+
+func TestStarQualityWatchdog(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	var mutex sync.Mutex
+	peak := uint16(30000)
+
+	fake.handle("get_star_image", func([]json.RawMessage) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return starImage(peak), nil
+	})
+	fake.handle("loop", func([]json.RawMessage) (interface{}, error) {
+		go func() {
+			for i := 1; i <= 3; i++ {
+				fake.emit(&phd2.LoopingExposuresEvent{Event: phd2.Event{Event: "LoopingExposures"}, Frame: i})
+			}
+		}()
+		return 0, nil
+	})
+	fake.result("find_star", []float64{10.4, 20.6})
+	fake.handle("guide", func([]json.RawMessage) (interface{}, error) {
+		go func() {
+			fake.emit(&phd2.StartGuidingEvent{Event: phd2.Event{Event: "StartGuiding"}})
+			fake.emit(&phd2.SettleDoneEvent{Event: phd2.Event{Event: "SettleDone"}})
+		}()
+		return 0, nil
+	})
+
+	degraded := make(chan phd2.StarQualityReport, 10)
+	recovered := make(chan phd2.StarQualityReport, 10)
+	w := phd2.NewStarQualityWatchdog(c, phd2.StarQualityWatchdogConfig{
+		ImageInterval: 10 * time.Millisecond,
+		OnDegraded: func(report phd2.StarQualityReport) {
+			degraded <- report
+		},
+		OnRecovered: func(report phd2.StarQualityReport) {
+			recovered <- report
+		},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, w)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx) // nolint: errcheck
+
+	steps := func(n int, snr, mass float64) {
+		for i := 0; i < n; i++ {
+			fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}, SNR: snr, StarMass: mass})
+		}
+	}
+
+	reselection, err := w.Reselect(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, reselection, "nothing to do while the star is good")
+
+	fake.emit(&phd2.StartGuidingEvent{Event: phd2.Event{Event: "StartGuiding"}})
+	steps(20, 30, 1000)
+	steps(10, 20, 400)
+
+	report := <-degraded
+	assert.Equal(t, phd2.StarQualityFading, report.Problem)
+
+	// A star that recovers needs no new star.
+	steps(10, 30, 1000)
+	assert.Equal(t, phd2.StarQualityFading, (<-recovered).Problem)
+
+	reselection, err = w.Reselect(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, reselection)
+
+	steps(10, 20, 400)
+
+	report = <-degraded
+	assert.Equal(t, phd2.StarQualityFading, report.Problem)
+	assert.True(t, report.StarMass < 500)
+	assert.Equal(t, 1000.0, report.BaselineStarMass)
+
+	reselection, err = w.Reselect(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, reselection)
+	assert.Equal(t, phd2.StarQualityFading, reselection.Before.Problem)
+	assert.Equal(t, 10, reselection.Position.X)
+	assert.Equal(t, 21, reselection.Position.Y)
+	assert.Equal(t, uint16(30000), reselection.Peak)
+	assert.Len(t, fake.callsTo("guide"), 1)
+
+	// The star saturates, and so does the only other one.
+	mutex.Lock()
+	peak = 65535
+	mutex.Unlock()
+
+	report = <-degraded
+	assert.Equal(t, phd2.StarQualitySaturated, report.Problem)
+	assert.Equal(t, uint16(65535), report.Peak)
+
+	_, err = w.Reselect(ctx)
+	assert.Error(t, err)
+	assert.Len(t, fake.callsTo("guide"), 1, "a saturated star is not guided on")
+}
+
+func TestStarQualityWatchdogCameraBits(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	// A 12 bit camera saturates at 4095.
+	fake.result("get_star_image", starImage(4095))
+
+	degraded := make(chan phd2.StarQualityReport, 10)
+	w := phd2.NewStarQualityWatchdog(c, phd2.StarQualityWatchdogConfig{
+		CameraBits:    12,
+		ImageInterval: 10 * time.Millisecond,
+		OnDegraded: func(report phd2.StarQualityReport) {
+			degraded <- report
+		},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, w)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx) // nolint: errcheck
+
+	fake.emit(&phd2.StartGuidingEvent{Event: phd2.Event{Event: "StartGuiding"}})
+
+	select {
+	case report := <-degraded:
+		assert.Equal(t, phd2.StarQualitySaturated, report.Problem)
+		assert.Equal(t, uint16(4095), report.Peak)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for saturation")
+	}
+}
+
+func TestStarQualityWatchdogImageError(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	fake.handle("get_star_image", func([]json.RawMessage) (interface{}, error) {
+		return nil, errors.New("no star selected")
+	})
+
+	imageErrors := make(chan error, 10)
+	w := phd2.NewStarQualityWatchdog(c, phd2.StarQualityWatchdogConfig{
+		ImageInterval: 10 * time.Millisecond,
+		OnImageError: func(err error) {
+			imageErrors <- err
+		},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, w)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx) // nolint: errcheck
+
+	fake.emit(&phd2.StartGuidingEvent{Event: phd2.Event{Event: "StartGuiding"}})
+
+	// Run carries on, and the image is checked again.
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-imageErrors:
+			assert.Error(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the image error")
+		}
+	}
+}
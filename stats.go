@@ -0,0 +1,65 @@
+package phd2
+
+import "math"
+
+// mean returns the arithmetic mean of the values, or 0 if there are none.
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+
+	return sum / float64(len(values))
+}
+
+// stdDev returns the population standard deviation of the values.
+func stdDev(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	m := mean(values)
+
+	var sum float64
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+
+	return math.Sqrt(sum / float64(len(values)))
+}
+
+// linearFit fits y = slope*x + intercept by least squares and returns the
+// coefficient of determination alongside. All are 0 if there are fewer than
+// two distinct x values.
+func linearFit(xs, ys []float64) (slope, intercept, r2 float64) {
+	if len(xs) < 2 || len(xs) != len(ys) {
+		return 0, 0, 0
+	}
+
+	mx, my := mean(xs), mean(ys)
+
+	var sxx, sxy, syy float64
+	for i := range xs {
+		dx, dy := xs[i]-mx, ys[i]-my
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+
+	if sxx == 0 {
+		return 0, 0, 0
+	}
+
+	slope = sxy / sxx
+	intercept = my - slope*mx
+
+	if syy == 0 {
+		return slope, intercept, 1
+	}
+
+	return slope, intercept, sxy * sxy / (sxx * syy)
+}
@@ -0,0 +1,311 @@
+package phd2
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TransparencySignal is a change in transparency detected by a
+// TransparencyMonitor.
+type TransparencySignal string
+
+const (
+	// TransparencyDropping means the star has dimmed noticeably.
+	TransparencyDropping = TransparencySignal("TransparencyDropping")
+	// TransparencyCloudedOut means the star has dimmed so much, or been lost
+	// so often, that imaging is pointless.
+	TransparencyCloudedOut = TransparencySignal("CloudedOut")
+	// TransparencyClearAgain means the star has recovered after dropping or
+	// being clouded out.
+	TransparencyClearAgain = TransparencySignal("ClearAgain")
+)
+
+// TransparencyReport describes a TransparencySignal.
+type TransparencyReport struct {
+	Signal TransparencySignal
+	// Transparency is the recent star mass as a fraction of the baseline.
+	Transparency float64
+	// SNR and StarMass are the recent averages, and BaselineSNR and
+	// BaselineStarMass the baseline.
+	SNR              float64
+	StarMass         float64
+	BaselineSNR      float64
+	BaselineStarMass float64
+	Time             time.Time
+	// Err is set if pausing or resuming PHD2 failed.
+	Err error
+}
+
+// TransparencyMonitorConfig configures a TransparencyMonitor.
+type TransparencyMonitorConfig struct {
+	// BaselineFrames is how many guide steps the baseline is first averaged
+	// over. While the sky is clear, the baseline then follows the star mass
+	// with the same time constant. Defaults to 20.
+	BaselineFrames int
+	// Frames is how many guide steps the recent star mass is averaged over.
+	// Defaults to 5.
+	Frames int
+	// Dropping, CloudedOut and Clear are fractions of the baseline star mass.
+	// Below Dropping transparency is dropping and below CloudedOut it is
+	// clouded out. It is only clear again once above Clear, which is higher
+	// than Dropping so the signals do not flicker. They default to 0.7, 0.3
+	// and 0.85.
+	Dropping   float64
+	CloudedOut float64
+	Clear      float64
+	// LostFrames is how many times in a row the star may be lost before it is
+	// clouded out. Defaults to 3.
+	LostFrames int
+	// Pause pauses PHD2 when clouded out and resumes it when clear again.
+	// PHD2 sends no guide steps while paused, so every ProbeInterval it is
+	// resumed for long enough to measure the star, and paused again if it is
+	// still clouded out. ProbeInterval defaults to a minute.
+	Pause         bool
+	ProbeInterval time.Duration
+
+	// OnSignal, if set, is called for every signal. It is called from the
+	// goroutine running Run.
+	OnSignal func(TransparencyReport)
+}
+
+// TransparencyMonitor detects clouds from the star mass and SNR in guide steps
+// and from the star being lost. The baseline is restarted each time guiding
+// starts, as the star may have changed. Changing the guide exposure changes the
+// star mass, so it should not be changed automatically while monitoring.
+//
+// TransparencyMonitor must receive the client's events through HandleEvent
+// (see DispatchEvents).
+type TransparencyMonitor struct {
+	c      *RPCClient
+	config TransparencyMonitorConfig
+	queue  *eventQueue
+
+	// state is the last signal sent, or "" while clear.
+	state TransparencySignal
+	// paused is true while PHD2 is paused, and probing while it has been
+	// resumed to check whether it is clear again.
+	paused  bool
+	probing bool
+
+	baselineFrames int
+	baselineSNR    float64
+	baselineMass   float64
+	snr            []float64
+	mass           []float64
+	lost           int
+}
+
+// NewTransparencyMonitor creates a new TransparencyMonitor.
+func NewTransparencyMonitor(c *RPCClient, config TransparencyMonitorConfig) *TransparencyMonitor {
+	if config.BaselineFrames <= 0 {
+		config.BaselineFrames = 20
+	}
+
+	if config.Frames <= 0 {
+		config.Frames = 5
+	}
+
+	if config.Dropping <= 0 {
+		config.Dropping = 0.7
+	}
+
+	if config.CloudedOut <= 0 {
+		config.CloudedOut = 0.3
+	}
+
+	if config.Clear <= 0 {
+		config.Clear = 0.85
+	}
+
+	if config.LostFrames <= 0 {
+		config.LostFrames = 3
+	}
+
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = time.Minute
+	}
+
+	return &TransparencyMonitor{
+		c:      c,
+		config: config,
+		queue:  newEventQueue(),
+	}
+}
+
+// HandleEvent queues events for Run.
+func (m *TransparencyMonitor) HandleEvent(evt interface{}) {
+	m.queue.HandleEvent(evt)
+}
+
+// Run monitors transparency until the context is done.
+func (m *TransparencyMonitor) Run(ctx context.Context) error {
+	var probe <-chan time.Time
+
+	for {
+		select {
+		case evt := <-m.queue.events:
+			m.handleEvent(evt)
+		case <-probe:
+			// Re-armed below if the probe could not resume PHD2.
+			probe = nil
+			m.startProbe()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		switch {
+		case !m.paused:
+			probe = nil
+		case probe == nil:
+			probe = time.After(m.config.ProbeInterval)
+		}
+	}
+}
+
+func (m *TransparencyMonitor) handleEvent(evt interface{}) {
+	switch e := evt.(type) {
+	case *StartGuidingEvent:
+		m.baselineFrames = 0
+		m.snr, m.mass = nil, nil
+		m.lost = 0
+	case *StarLostEvent:
+		m.lost++
+		if m.lost < m.config.LostFrames {
+			return
+		}
+
+		if m.probing {
+			m.pause()
+		} else if m.state != TransparencyCloudedOut {
+			m.signal(TransparencyCloudedOut, m.recent())
+		}
+	case *GuideStepEvent:
+		if e.StarMass <= 0 {
+			return
+		}
+
+		m.lost = 0
+		m.step(e)
+	}
+}
+
+// startProbe resumes PHD2 to measure the star.
+func (m *TransparencyMonitor) startProbe() {
+	err := m.c.SetPaused(false, false)
+	if err != nil {
+		// Try again at the next probe.
+		return
+	}
+
+	m.paused = false
+	m.probing = true
+	m.snr, m.mass = nil, nil
+	m.lost = 0
+}
+
+// pause pauses PHD2 again after a probe found it still clouded out.
+func (m *TransparencyMonitor) pause() {
+	m.probing = false
+	m.paused = m.c.SetPaused(true, false) == nil
+}
+
+func (m *TransparencyMonitor) step(e *GuideStepEvent) {
+	if m.baselineFrames < m.config.BaselineFrames {
+		// Average the first frames to start the baseline.
+		m.baselineFrames++
+		n := float64(m.baselineFrames)
+		m.baselineSNR += (e.SNR - m.baselineSNR) / n
+		m.baselineMass += (e.StarMass - m.baselineMass) / n
+		return
+	}
+
+	m.snr = append(m.snr, e.SNR)
+	m.mass = append(m.mass, e.StarMass)
+
+	if len(m.mass) > m.config.Frames {
+		m.snr = m.snr[1:]
+		m.mass = m.mass[1:]
+	}
+
+	if len(m.mass) < m.config.Frames {
+		return
+	}
+
+	report := m.recent()
+
+	if m.probing {
+		if report.Transparency >= m.config.Clear {
+			m.signal(TransparencyClearAgain, report)
+		} else {
+			m.pause()
+		}
+		return
+	}
+
+	switch {
+	case report.Transparency < m.config.CloudedOut:
+		if m.state != TransparencyCloudedOut {
+			m.signal(TransparencyCloudedOut, report)
+		}
+	case report.Transparency < m.config.Dropping:
+		if m.state == "" {
+			m.signal(TransparencyDropping, report)
+		}
+	case report.Transparency >= m.config.Clear:
+		if m.state != "" {
+			m.signal(TransparencyClearAgain, report)
+		}
+	}
+
+	if m.state == "" {
+		// Follow slow changes while clear, such as the star rising.
+		f := float64(m.config.BaselineFrames)
+		m.baselineSNR += (e.SNR - m.baselineSNR) / f
+		m.baselineMass += (e.StarMass - m.baselineMass) / f
+	}
+}
+
+// recent reports the recent averages against the baseline.
+func (m *TransparencyMonitor) recent() TransparencyReport {
+	report := TransparencyReport{
+		SNR:              mean(m.snr),
+		StarMass:         mean(m.mass),
+		BaselineSNR:      m.baselineSNR,
+		BaselineStarMass: m.baselineMass,
+	}
+
+	if m.baselineMass > 0 {
+		report.Transparency = report.StarMass / m.baselineMass
+	}
+
+	return report
+}
+
+func (m *TransparencyMonitor) signal(signal TransparencySignal, report TransparencyReport) {
+	report.Signal = signal
+	report.Time = time.Now()
+
+	switch signal {
+	case TransparencyClearAgain:
+		m.state = ""
+		m.probing = false
+		if m.paused {
+			report.Err = errors.Wrap(m.c.SetPaused(false, false), "error resuming")
+			m.paused = report.Err != nil
+		}
+	case TransparencyCloudedOut:
+		m.state = signal
+		if m.config.Pause {
+			report.Err = errors.Wrap(m.c.SetPaused(true, false), "error pausing")
+			m.paused = report.Err == nil
+		}
+	default:
+		m.state = signal
+	}
+
+	if m.config.OnSignal != nil {
+		m.config.OnSignal(report)
+	}
+}
@@ -0,0 +1,94 @@
+package phd2_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goastro/phd2"
+)
+
+func TestTransparencyMonitor(t *testing.T) {
+	c, fake := newFakePHD2(t)
+	defer fake.close()
+
+	signals := make(chan phd2.TransparencyReport, 10)
+	m := phd2.NewTransparencyMonitor(c, phd2.TransparencyMonitorConfig{
+		Pause:         true,
+		ProbeInterval: 20 * time.Millisecond,
+		OnSignal: func(report phd2.TransparencyReport) {
+			signals <- report
+		},
+	})
+
+	events, err := c.Subscribe()
+	require.NoError(t, err)
+	go phd2.DispatchEvents(events, m)
+
+	paused := make(chan string, 10)
+	resumes := 0
+	fake.handle("set_paused", func(params []json.RawMessage) (interface{}, error) {
+		paused <- string(params[0])
+		if string(params[0]) == "false" {
+			resumes++
+			if resumes == 1 {
+				return nil, errors.New("resume failed")
+			}
+		}
+		return 0, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx) // nolint: errcheck
+
+	steps := func(n int, mass float64) {
+		for i := 0; i < n; i++ {
+			fake.emit(&phd2.GuideStepEvent{Event: phd2.Event{Event: "GuideStep"}, SNR: mass / 20, StarMass: mass})
+		}
+	}
+
+	fake.emit(&phd2.StartGuidingEvent{Event: phd2.Event{Event: "StartGuiding"}})
+	steps(25, 1000)
+	steps(5, 600)
+
+	report := <-signals
+	assert.Equal(t, phd2.TransparencyDropping, report.Signal)
+	assert.True(t, report.Transparency < 0.7)
+	assert.InDelta(t, report.BaselineStarMass/20, report.BaselineSNR, 1e-9)
+
+	steps(5, 200)
+
+	report = <-signals
+	assert.Equal(t, phd2.TransparencyCloudedOut, report.Signal)
+	assert.NoError(t, report.Err)
+	assert.Equal(t, "true", <-paused)
+
+	// A probe that fails to resume is tried again, and then finds it still
+	// clouded out and pauses again.
+	assert.Equal(t, "false", <-paused)
+	assert.Equal(t, "false", <-paused)
+	for i := 0; i < 3; i++ {
+		fake.emit(&phd2.StarLostEvent{Event: phd2.Event{Event: "StarLost"}})
+	}
+	assert.Equal(t, "true", <-paused)
+
+	// The next finds it clear.
+	assert.Equal(t, "false", <-paused)
+	steps(5, 900)
+
+	report = <-signals
+	assert.Equal(t, phd2.TransparencyClearAgain, report.Signal)
+	assert.True(t, report.Transparency >= 0.85)
+
+	select {
+	case p := <-paused:
+		t.Errorf("unexpected set_paused %s", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}